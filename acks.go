@@ -0,0 +1,482 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	ackMessagesKey = "ack-messages"
+	ackEscalation  = "escalation"
+
+	ackViaLink   = "link"
+	ackViaRabbit = "rabbit"
+
+	escalationSubjectPrefix = "[ESCALATED] "
+)
+
+type ackRecord struct {
+	Username string    `json:"username"`
+	Via      string    `json:"via"`
+	At       time.Time `json:"at"`
+}
+
+func (a ackRecord) MarshalBinary() ([]byte, error) {
+	return json.Marshal(a)
+}
+
+type ackReport struct {
+	MessageId    string      `json:"messageId"`
+	Subject      string      `json:"subject"`
+	State        string      `json:"state"`
+	AcceptedAt   time.Time   `json:"acceptedAt"`
+	AckDeadline  *time.Time  `json:"ackDeadline,omitempty"`
+	EscalatedAt  *time.Time  `json:"escalatedAt,omitempty"`
+	Recipients   int         `json:"recipients"`
+	Acknowledged []ackRecord `json:"acknowledged"`
+	Pending      []string    `json:"pending"`
+}
+
+type pendingEscalation struct {
+	Key      string `json:"key"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+func (p pendingEscalation) MarshalBinary() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func acksKey(key string) string {
+	return "acks-" + key
+}
+
+// ackToken signs the message key and user name, so the ack link can't be
+// forged for another message or user.
+func (ns *notificationServer) ackToken(key, username string) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(key + "\n" + username))
+	return payload + "." + ns.ackSignature(payload)
+}
+
+func (ns *notificationServer) ackSignature(payload string) string {
+	mac := hmac.New(sha256.New, ns.ackSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// parseAckToken returns the message key and user name of a valid ack token.
+func (ns *notificationServer) parseAckToken(token string) (string, string, *apiError) {
+	invalid := newApiError(http.StatusBadRequest, errInvalidAckToken, "invalid ack token")
+
+	dot := strings.LastIndex(token, ".")
+	if dot < 0 {
+		return "", "", invalid
+	}
+
+	payload, signature := token[:dot], token[dot+1:]
+	if !hmac.Equal([]byte(signature), []byte(ns.ackSignature(payload))) {
+		return "", "", invalid
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return "", "", invalid
+	}
+
+	parts := strings.SplitN(string(decoded), "\n", 2)
+	if len(parts) != 2 {
+		return "", "", invalid
+	}
+
+	return parts[0], parts[1], nil
+}
+
+func (ns *notificationServer) ackURL(token string) string {
+	return strings.TrimRight(ns.ackBaseURL, "/") + "/ack/" + token
+}
+
+// addAck adds the ack link and token of the recipient to a delivery of a
+// message that requests acknowledgement.
+func (ns *notificationServer) addAck(d *delivery) {
+	if !d.Notification.RequireAck {
+		return
+	}
+
+	token := ns.ackToken(d.Notification.Thread, d.Username)
+	d.Notification.AckToken = token
+	d.Notification.AckURL = ns.ackURL(token)
+}
+
+// isFirstAckAddressType tells if a message that requests acknowledgement is
+// sent to the address type right away. Other address types are only used
+// when the message is escalated. Users without any of the ack address types
+// get the message on all their address types.
+func (ns *notificationServer) isFirstAckAddressType(ci Subscription, addressType string) bool {
+	hasAckAddress := false
+	for _, t := range ns.ackAddressTypes {
+		if ci.Addresses[t] != "" {
+			hasAckAddress = true
+		}
+		if t == addressType {
+			return true
+		}
+	}
+
+	return !hasAckAddress
+}
+
+// scheduleEscalation escalates the message when nobody acknowledged it in time.
+func (ns *notificationServer) scheduleEscalation(ctx context.Context, record messageRecord, deadline time.Time) error {
+	if err := ns.escalationQueue.Add(ctx, record.Key, pendingEscalation{Key: record.Key}, deadline); err != nil {
+		return err
+	}
+
+	return ns.redisClient.ZAdd(ctx, ackMessagesKey, &redis.Z{Score: float64(record.AcceptedAt.UnixMilli()), Member: record.Key}).Err()
+}
+
+// StartEscalations escalates unacknowledged messages when their deadline
+// passed until ctx is cancelled.
+func (ns *notificationServer) StartEscalations(ctx context.Context, pollInterval time.Duration) {
+	go ns.escalationQueue.Consume(ctx, queueLease, pollInterval, ns.processEscalation)
+}
+
+func (ns *notificationServer) processEscalation(ctx context.Context, key string, payload []byte) {
+	var pe pendingEscalation
+	if err := json.Unmarshal(payload, &pe); err != nil {
+		log.Printf("Dropping unreadable escalation %s: %v\n", key, err)
+		ns.escalationQueue.Remove(ctx, key)
+		return
+	}
+
+	pe.Attempts++
+	err := ns.escalate(ctx, key)
+	if err != nil && pe.Attempts < ns.deliveryMaxAttempts {
+		log.Printf("Unable to escalate message %s (attempt %d): %v\n", key, pe.Attempts, err)
+		if err := ns.escalationQueue.Add(ctx, key, pe, time.Now().Add(queueLease)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if err != nil {
+		log.Printf("Giving up on escalating message %s after %d attempts: %v\n", key, pe.Attempts, err)
+	}
+
+	if err := ns.escalationQueue.Remove(ctx, key); err != nil {
+		log.Println(err)
+	}
+}
+
+// escalate sends the message over the other address types of the recipients
+// when nobody acknowledged it.
+func (ns *notificationServer) escalate(ctx context.Context, key string) error {
+	record, err := ns.getMessage(ctx, key)
+	if err == redis.Nil {
+		log.Printf("Message %s expired before it could be escalated\n", key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if record.State == messageResolved || record.EscalatedAt != nil {
+		return nil
+	}
+
+	acks, err := ns.redisClient.HLen(ctx, acksKey(key)).Result()
+	if err != nil {
+		return err
+	}
+	if acks > 0 {
+		return nil
+	}
+
+	users, err := ns.getRecipients(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	//mark the message escalated first, so a concurrent resolve or escalation wins or loses as a whole
+	now := time.Now()
+	escalating := false
+	record, err = ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+		escalating = stored.State != messageResolved && stored.EscalatedAt == nil
+		if escalating {
+			stored.EscalatedAt = &now
+		}
+		return nil
+	})
+	if err == redis.Nil {
+		log.Printf("Message %s expired before it could be escalated\n", key)
+		return nil
+	}
+	if err != nil || !escalating {
+		return err
+	}
+
+	log.Printf("Nobody acknowledged message %s, escalating\n", key)
+
+	n := record.Message.Notification()
+	n.Subject = escalationSubjectPrefix + n.Subject
+	n.Thread = key
+	n.FollowUp = ackEscalation
+
+	_, err = ns.queueDeliveriesTo(ctx, followUpKey(key, ackEscalation), usersByName(users), n, func(ci Subscription, addressType string) bool {
+		return !ns.isFirstAckAddressType(ci, addressType)
+	})
+	if err != nil {
+		//the next attempt escalates again
+		if _, err := ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+			stored.EscalatedAt = nil
+			return nil
+		}); err != nil {
+			log.Println(err)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// acknowledge records that the user of the token saw the message.
+func (ns *notificationServer) acknowledge(ctx context.Context, token, via string) (messageRecord, *apiError) {
+	key, username, apiErr := ns.parseAckToken(token)
+	if apiErr != nil {
+		return messageRecord{}, apiErr
+	}
+
+	record, err := ns.getMessage(ctx, key)
+	if err == redis.Nil {
+		return record, newApiError(http.StatusNotFound, errMessageNotFound, "message %s not found", key)
+	}
+	if err != nil {
+		return record, toApiError(err)
+	}
+
+	ttl, err := ns.redisClient.PTTL(ctx, messageRecordKey(key)).Result()
+	if err != nil {
+		return record, toApiError(err)
+	}
+
+	_, err = ns.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, acksKey(key), username, ackRecord{Username: username, Via: via, At: time.Now()})
+		if ttl > 0 {
+			pipe.PExpire(ctx, acksKey(key), ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return record, toApiError(err)
+	}
+
+	log.Printf("Message %s acknowledged by %s via %s\n", key, username, via)
+	return record, nil
+}
+
+func (ns *notificationServer) getAckReport(ctx context.Context, record messageRecord) (ackReport, error) {
+	report := ackReport{
+		MessageId:    record.Key,
+		Subject:      record.Message.Subject,
+		State:        record.State,
+		AcceptedAt:   record.AcceptedAt,
+		AckDeadline:  record.AckDeadline,
+		EscalatedAt:  record.EscalatedAt,
+		Recipients:   record.Recipients,
+		Acknowledged: []ackRecord{},
+		Pending:      []string{},
+	}
+
+	acks, err := ns.redisClient.HGetAll(ctx, acksKey(record.Key)).Result()
+	if err != nil {
+		return report, err
+	}
+
+	for _, ackString := range acks {
+		var ack ackRecord
+		if err := json.Unmarshal([]byte(ackString), &ack); err != nil {
+			log.Println(err)
+			continue
+		}
+		report.Acknowledged = append(report.Acknowledged, ack)
+	}
+
+	sort.Slice(report.Acknowledged, func(i, j int) bool {
+		return report.Acknowledged[i].At.Before(report.Acknowledged[j].At)
+	})
+
+	users, err := ns.getRecipients(ctx, record.Key)
+	if err != nil {
+		return report, err
+	}
+
+	for _, u := range users {
+		if _, ok := acks[u]; !ok {
+			report.Pending = append(report.Pending, u)
+		}
+	}
+	sort.Strings(report.Pending)
+
+	return report, nil
+}
+
+func (ns *notificationServer) listAcksHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	keys, err := ns.redisClient.ZRevRange(ctx, ackMessagesKey, 0, -1).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	reports := []ackReport{}
+	for _, key := range keys {
+		record, err := ns.getMessage(ctx, key)
+		if err == redis.Nil { //expired, forget about it
+			ns.redisClient.ZRem(ctx, ackMessagesKey, key)
+			continue
+		}
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		report, err := ns.getAckReport(ctx, record)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		reports = append(reports, report)
+	}
+
+	writeData(w, http.StatusOK, reports)
+}
+
+func (ns *notificationServer) messageAcksHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	ctx := r.Context()
+	key := mux.Vars(r)["id"]
+
+	record, err := ns.getMessage(ctx, key)
+	if err == redis.Nil {
+		writeError(w, newApiError(http.StatusNotFound, errMessageNotFound, "message %s not found", key))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	if !record.Message.RequireAck {
+		writeError(w, newApiError(http.StatusNotFound, errMessageNotFound, "message %s doesn't request acknowledgement", key))
+		return
+	}
+
+	report, err := ns.getAckReport(ctx, record)
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	writeData(w, http.StatusOK, report)
+}
+
+// ackPageHandler shows the message with a button to acknowledge it. The ack
+// itself is a POST, so mail scanners that follow links don't acknowledge.
+func (ns *notificationServer) ackPageHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	ctx := r.Context()
+	token := mux.Vars(r)["token"]
+
+	data := ackPageData{
+		AppName: ns.appName,
+		Token:   token,
+	}
+
+	key, username, apiErr := ns.parseAckToken(token)
+	if apiErr != nil {
+		data.Error = apiErr.Message
+		renderAckPage(w, apiErr.Status, data)
+		return
+	}
+
+	record, err := ns.getMessage(ctx, key)
+	if err != nil {
+		data.Error = "This message has expired."
+		renderAckPage(w, http.StatusNotFound, data)
+		return
+	}
+	data.Subject = record.Message.Subject
+
+	acked, err := ns.redisClient.HExists(ctx, acksKey(key), username).Result()
+	if err != nil {
+		log.Println(err)
+	}
+	data.Acknowledged = acked
+
+	renderAckPage(w, http.StatusOK, data)
+}
+
+func (ns *notificationServer) ackHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	token := mux.Vars(r)["token"]
+	data := ackPageData{
+		AppName: ns.appName,
+		Token:   token,
+	}
+
+	record, apiErr := ns.acknowledge(r.Context(), token, ackViaLink)
+	if apiErr != nil {
+		data.Error = apiErr.Message
+		renderAckPage(w, apiErr.Status, data)
+		return
+	}
+
+	data.Subject = record.Message.Subject
+	data.Acknowledged = true
+	renderAckPage(w, http.StatusOK, data)
+}
+
+type ackPageData struct {
+	AppName      string
+	Token        string
+	Subject      string
+	Acknowledged bool
+	Error        string
+}
+
+func renderAckPage(w http.ResponseWriter, status int, data ackPageData) {
+	tmpl := template.Must(template.ParseFiles("ack.tmpl"))
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	if err := tmpl.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// Error codes returned in the error envelope of the api.
+const (
+	errUnauthorized                = "unauthorized"
+	errInvalidRequest              = "invalid_request"
+	errInvalidMessage              = "invalid_message"
+	errUnknownTargetType           = "unknown_target_type"
+	errEnvironmentNotConfigured    = "environment_not_configured"
+	errTemplateNotFound            = "template_not_found"
+	errTemplateRenderFailed        = "template_render_failed"
+	errInvalidTemplate             = "invalid_template"
+	errDuplicateMessage            = "duplicate_message"
+	errMessageNotFound             = "message_not_found"
+	errMessageNotSent              = "message_not_sent"
+	errMessageResolved             = "message_resolved"
+	errMessageDispatching          = "message_dispatching"
+	errScheduledNotFound           = "scheduled_message_not_found"
+	errBatchTooLarge               = "batch_too_large"
+	errTargetResolutionFailed      = "target_resolution_failed"
+	errRateLimited                 = "rate_limited"
+	errQuietHoursOverrideForbidden = "quiet_hours_override_forbidden"
+	errInvalidAckToken             = "invalid_ack_token"
+	errInternal                    = "internal_error"
+)
+
+// apiResponse is the envelope of every api response. Successful responses
+// hold data, failed responses an error. A duplicate message holds both, the
+// data being the result of the original message.
+type apiResponse struct {
+	Data  interface{} `json:"data,omitempty"`
+	Error *apiError   `json:"error,omitempty"`
+}
+
+type apiError struct {
+	Status  int    `json:"-"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string {
+	return e.Message
+}
+
+func newApiError(status int, code, format string, args ...interface{}) *apiError {
+	return &apiError{
+		Status:  status,
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+func writeResponse(w http.ResponseWriter, status int, response apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeData(w http.ResponseWriter, status int, data interface{}) {
+	writeResponse(w, status, apiResponse{Data: data})
+}
+
+func writeError(w http.ResponseWriter, e *apiError) {
+	writeResponse(w, e.Status, apiResponse{Error: e})
+}
+
+// toApiError returns err when it is an api error and wraps it as an internal
+// error otherwise.
+func toApiError(err error) *apiError {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr
+	}
+
+	return newApiError(http.StatusInternalServerError, errInternal, "%v", err)
+}
+
+// requireApiUser checks the basic auth credentials against the configured api
+// users. When they don't match an error is written and false is returned.
+func (ns *notificationServer) requireApiUser(w http.ResponseWriter, r *http.Request) (string, bool) {
+	u, p, ok := r.BasicAuth()
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cfNotificationService"`)
+		writeError(w, newApiError(http.StatusUnauthorized, errUnauthorized, "api credentials required"))
+		return "", false
+	}
+
+	if expectedPw, ok := ns.apiUsers[u]; !ok || expectedPw != p {
+		w.Header().Set("WWW-Authenticate", `Basic realm="cfNotificationService"`)
+		writeError(w, newApiError(http.StatusUnauthorized, errUnauthorized, "invalid api credentials"))
+		return "", false
+	}
+
+	return u, true
+}
+
+// writeRateLimitError writes a rate limit error with the Retry-After header.
+func writeRateLimitError(w http.ResponseWriter, e *rateLimitError) {
+	w.Header().Set("Retry-After", strconv.Itoa(e.RetryAfterSeconds()))
+	writeError(w, newApiError(http.StatusTooManyRequests, errRateLimited, "%v", e))
+}
+
+func openApiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	http.ServeFile(w, r, "openapi.json")
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+)
+
+const (
+	batchAccepted  = "accepted"
+	batchDuplicate = "duplicate"
+	batchInvalid   = "invalid"
+	batchFailed    = "error"
+	batchLimited   = "rate_limited"
+)
+
+type batchResult struct {
+	Index  int         `json:"index"`
+	Id     string      `json:"id,omitempty"`
+	Status string      `json:"status"`
+	Code   string      `json:"code,omitempty"`
+	Reason string      `json:"reason,omitempty"`
+	Result *sendResult `json:"result,omitempty"`
+}
+
+type batchResponse struct {
+	Results []batchResult `json:"results"`
+}
+
+// readBatch reads the messages of a batch, which is either a json array or
+// newline delimited json. Every message is returned as raw json, so one
+// message that doesn't decode doesn't fail the others.
+func readBatch(body io.Reader) ([]json.RawMessage, error) {
+	reader := bufio.NewReader(body)
+
+	//skip leading white space to find out if this is an array
+	for {
+		b, err := reader.Peek(1)
+		if err == io.EOF {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.ContainsAny(b, " \t\r\n") {
+			break
+		}
+		reader.ReadByte()
+	}
+
+	var messages []json.RawMessage
+
+	if b, _ := reader.Peek(1); b[0] == '[' {
+		if err := json.NewDecoder(reader).Decode(&messages); err != nil {
+			return nil, err
+		}
+		return messages, nil
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		messages = append(messages, json.RawMessage(append([]byte{}, line...)))
+	}
+
+	return messages, scanner.Err()
+}
+
+func (ns *notificationServer) sendBatchHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	apiUser, ok := ns.requireApiUser(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+
+	rawMessages, err := readBatch(r.Body)
+	if err != nil {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "Unable to read batch: %v", err))
+		return
+	}
+
+	if len(rawMessages) > ns.batchMaxMessages {
+		writeError(w, newApiError(http.StatusRequestEntityTooLarge, errBatchTooLarge, "Batch holds %d messages, the maximum is %d", len(rawMessages), ns.batchMaxMessages))
+		return
+	}
+
+	response := batchResponse{
+		Results: []batchResult{},
+	}
+
+	for i, rawMessage := range rawMessages {
+		result := batchResult{Index: i}
+
+		var msg messageBody
+		if err := json.Unmarshal(rawMessage, &msg); err != nil {
+			result.Status = batchInvalid
+			result.Code = errInvalidRequest
+			result.Reason = err.Error()
+			response.Results = append(response.Results, result)
+			continue
+		}
+		result.Id = msg.Id
+
+		msg, apiErr := ns.prepareMessage(ctx, msg)
+		if apiErr != nil {
+			result.Status = batchInvalid
+			if apiErr.Status == http.StatusInternalServerError {
+				result.Status = batchFailed
+			}
+			result.Code = apiErr.Code
+			result.Reason = apiErr.Message
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		if apiErr := ns.authorizeMessage(apiUser, msg); apiErr != nil {
+			result.Status = batchInvalid
+			result.Code = apiErr.Code
+			result.Reason = apiErr.Message
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		if rle := ns.checkRateLimits(ctx, apiUser, msg); rle != nil {
+			result.Status = batchLimited
+			result.Code = errRateLimited
+			result.Reason = rle.Error()
+			response.Results = append(response.Results, result)
+			continue
+		}
+
+		sent, status, apiErr := ns.acceptMessage(ctx, apiUser, msg)
+		switch {
+		case apiErr != nil:
+			result.Status = batchFailed
+			result.Code = apiErr.Code
+			result.Reason = apiErr.Message
+		case status == http.StatusConflict:
+			result.Status = batchDuplicate
+			result.Code = errDuplicateMessage
+			result.Result = &sent
+		default:
+			result.Status = batchAccepted
+			result.Result = &sent
+		}
+
+		response.Results = append(response.Results, result)
+	}
+
+	writeData(w, http.StatusOK, response)
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"empty", "", nil, false},
+		{"white space", " \n\t", nil, false},
+		{"array", `[{"id":"a"},{"id":"b"}]`, []string{`{"id":"a"}`, `{"id":"b"}`}, false},
+		{"indented array", "\n  [\n  {\"id\": \"a\"},\n  {\"id\": \"b\"}\n]\n", []string{`{"id": "a"}`, `{"id": "b"}`}, false},
+		{"empty array", "[]", []string{}, false},
+		{"array with an invalid message", `[{"id":"a"},"b",1]`, []string{`{"id":"a"}`, `"b"`, `1`}, false},
+		{"broken array", `[{"id":"a"},`, nil, true},
+		{"ndjson", "{\"id\":\"a\"}\n{\"id\":\"b\"}\n", []string{`{"id":"a"}`, `{"id":"b"}`}, false},
+		{"ndjson with blank lines and crlf", "{\"id\":\"a\"}\r\n\r\n  {\"id\":\"b\"}  \r\n", []string{`{"id":"a"}`, `{"id":"b"}`}, false},
+		{"ndjson without trailing newline", `{"id":"a"}`, []string{`{"id":"a"}`}, false},
+		{"ndjson with an invalid line", "{\"id\":\"a\"}\nnot json\n", []string{`{"id":"a"}`, `not json`}, false},
+		{"ndjson line too long", `{"id":"` + strings.Repeat("a", 2*1024*1024) + `"}`, nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readBatch(strings.NewReader(tt.in))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readBatch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			if (got == nil) != (tt.want == nil) || len(got) != len(tt.want) {
+				t.Fatalf("readBatch() = %q, want %q", got, tt.want)
+			}
+			for i := range got {
+				if string(got[i]) != tt.want[i] {
+					t.Errorf("message %d = %s, want %s", i, got[i], tt.want[i])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// StreamingUserGetter is implemented by user getters for targets that are
+// too large to resolve at once, like all users of a platform. They pass the
+// users to each page by page.
+type StreamingUserGetter interface {
+	StreamTargetUsers(t messageTarget, each func([]targetUser) error) error
+}
+
+// isStreamed tells if any of the targets of the message is resolved page by
+// page.
+func (ns *notificationServer) isStreamed(msg messageBody) bool {
+	for _, t := range msg.AllTargets() {
+		if _, ok := ns.userGetters[t.Type].(StreamingUserGetter); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveInBackground hands a message with streamed targets to the
+// scheduler, so the request doesn't wait for the recipients to be resolved.
+// The queue lease makes sure one instance dispatches it, also when the
+// instance that accepted it goes away.
+func (ns *notificationServer) resolveInBackground(ctx context.Context, record messageRecord) error {
+	return ns.scheduleQueue.Add(ctx, record.Key, record, time.Now())
+}
+
+// streamTargetUsers passes the users of a target to each, page by page for
+// streaming user getters and at once for the others.
+func (ns *notificationServer) streamTargetUsers(t messageTarget, each func([]targetUser) error) error {
+	getUsers, ok := ns.userGetters[t.Type]
+	if !ok {
+		return fmt.Errorf("%s target type not implemented yet", t.Type)
+	}
+
+	if sg, ok := getUsers.(StreamingUserGetter); ok {
+		return sg.StreamTargetUsers(t, each)
+	}
+
+	users, err := getTargetUsers(getUsers, t)
+	if err != nil {
+		return err
+	}
+
+	return each(users)
+}
+
+// dispatchStreamed dispatches a message with streamed targets. Every page of
+// users is queued before the next one is fetched, so large foundations
+// don't have to fit in memory. Recipients stored by an earlier attempt are
+// skipped, so an instance that takes over the dispatch doesn't notify them
+// twice. The dispatch stops when the message is cancelled or released.
+func (ns *notificationServer) dispatchStreamed(ctx context.Context, record messageRecord) (messageRecord, error) {
+	msg := record.Message
+	n := ns.messageNotification(ctx, record)
+
+	seen := make(map[string]bool)
+	previous, err := ns.getRecipients(ctx, record.Key)
+	if err != nil {
+		log.Println(err)
+	}
+	for _, u := range previous {
+		seen[u] = true
+	}
+
+	record.Targets = nil
+	failed := 0
+
+	var released error
+
+	for _, t := range msg.AllTargets() {
+		result := targetResult{Target: t}
+
+		err := ns.streamTargetUsers(t, func(page []targetUser) error {
+			result.Users += len(page)
+
+			var users []targetUser
+			for _, u := range page {
+				if !seen[u.Username] {
+					seen[u.Username] = true
+					users = append(users, u)
+				}
+			}
+			if len(users) == 0 {
+				return nil
+			}
+
+			queued, err := ns.queueDeliveries(ctx, record.Key, users, n)
+			record.Recipients += len(users)
+			record.Queued += queued
+			if err != nil {
+				return err
+			}
+
+			//remember who got the message, follow-ups go to the same users. This happens after
+			//queueing, so an instance that takes over skips only users that were really queued
+			if err := ns.storeRecipients(ctx, record.Key, targetUsernames(users)); err == redis.Nil {
+				released = fmt.Errorf("message %s was released", record.Key)
+				return released
+			} else if err != nil {
+				log.Println(err)
+			}
+
+			//keep the lease on the message and its progress while the next page is fetched
+			if err := ns.scheduleQueue.Update(ctx, record.Key, record, time.Now().Add(queueLease)); err == redis.Nil {
+				released = fmt.Errorf("message %s is no longer queued", record.Key)
+				return released
+			} else if err != nil {
+				log.Println(err)
+			}
+			return nil
+		})
+		if released != nil {
+			return record, released
+		}
+		if err != nil {
+			log.Printf("Error retrieving users for %s: %v\n", t, err)
+			result.Error = err.Error()
+			failed++
+		}
+
+		record.Targets = append(record.Targets, result)
+	}
+
+	if failed == len(record.Targets) {
+		return record, newApiError(http.StatusInternalServerError, errTargetResolutionFailed, "Error retrieving users: %v", record.Targets[0].Error)
+	}
+
+	record.State = messageDispatched
+	return ns.completeDispatch(ctx, record), nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"log"
+	"net/url"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// CfAppUsageUserGetter selects the spaces with apps on a stack or buildpack
+// and returns the members of those spaces. Every recipient gets the names of
+// the affected apps in their spaces as target detail.
+type CfAppUsageUserGetter struct {
+	*cfEnvironments
+	//stack or buildpack
+	usage string
+}
+
+func NewCfStackUserGetter(envs *cfEnvironments) *CfAppUsageUserGetter {
+	return &CfAppUsageUserGetter{
+		cfEnvironments: envs,
+		usage:          "stack",
+	}
+}
+
+func NewCfBuildpackUserGetter(envs *cfEnvironments) *CfAppUsageUserGetter {
+	return &CfAppUsageUserGetter{
+		cfEnvironments: envs,
+		usage:          "buildpack",
+	}
+}
+
+func (au *CfAppUsageUserGetter) Get(env, name string) ([]string, error) {
+	users, err := au.GetTargetUsers(messageTarget{Type: au.usage, Environment: env, Id: name})
+	return targetUsernames(users), err
+}
+
+func (au *CfAppUsageUserGetter) TargetDetails() map[string]interface{} {
+	return map[string]interface{}{
+		au.usage: "",
+		"apps":   []string{},
+	}
+}
+
+func (au *CfAppUsageUserGetter) CheckRoles(t messageTarget) error {
+	return checkSpaceRoles(t.Roles)
+}
+
+func (au *CfAppUsageUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if err := au.CheckRoles(t); err != nil {
+		return nil, err
+	}
+
+	cf, err := au.client(t.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"lifecycle_type": {"buildpack"}}
+	if au.usage == "stack" {
+		query.Set("stacks", t.Id)
+	}
+
+	apps, err := cf.ListV3AppsByQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	appsBySpace := make(map[string][]string)
+	for _, app := range apps {
+		if au.usage == "buildpack" && !usesBuildpack(cf, app, t.Id) {
+			continue
+		}
+
+		spaceGuid := app.Relationships["space"].Data.GUID
+		appsBySpace[spaceGuid] = append(appsBySpace[spaceGuid], app.Name)
+	}
+
+	if len(appsBySpace) == 0 {
+		log.Printf("No apps found on %s %s in %s\n", au.usage, t.Id, t.Environment)
+		return []targetUser{}, nil
+	}
+
+	return cfSpaceMembersWith(cf, appsBySpace, "apps", t.Roles, map[string]interface{}{
+		au.usage: t.Id,
+	})
+}
+
+// StreamTargetUsers makes stack and buildpack targets resolve in the
+// background, looking up the droplets of a large foundation takes too long
+// for a request. The users are passed in one page, so every recipient gets
+// all the affected apps in their spaces.
+func (au *CfAppUsageUserGetter) StreamTargetUsers(t messageTarget, each func([]targetUser) error) error {
+	users, err := au.GetTargetUsers(t)
+	if err != nil {
+		return err
+	}
+
+	return each(users)
+}
+
+// usesBuildpack tells if an app runs on the buildpack. Apps that don't name
+// their buildpacks are checked against the buildpacks detected for their
+// current droplet.
+func usesBuildpack(cf *cfclient.Client, app cfclient.V3App, buildpack string) bool {
+	buildpacks := app.Lifecycle.BuildpackData.Buildpacks
+	if len(buildpacks) == 0 {
+		droplet, err := cf.GetCurrentDropletForV3App(app.GUID)
+		if err != nil {
+			//apps that were never staged have no droplet
+			return false
+		}
+
+		for _, detected := range droplet.Buildpacks {
+			buildpacks = append(buildpacks, detected.Name, detected.BuildpackName)
+		}
+	}
+
+	for _, b := range buildpacks {
+		if b == buildpack {
+			return true
+		}
+	}
+
+	return false
+}
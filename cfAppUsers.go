@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+)
+
+// CfAppUserGetter resolves an app to its space and returns the users with a
+// role in that space. Every recipient gets the app, space and org names as
+// target details.
+type CfAppUserGetter struct {
+	*cfEnvironments
+}
+
+func NewCfAppUserGetter(envs *cfEnvironments) *CfAppUserGetter {
+	return &CfAppUserGetter{
+		cfEnvironments: envs,
+	}
+}
+
+func (au *CfAppUserGetter) Get(env, appId string) ([]string, error) {
+	users, err := au.GetTargetUsers(messageTarget{Type: "app", Environment: env, Id: appId})
+	return targetUsernames(users), err
+}
+
+func (au *CfAppUserGetter) TargetDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"app":     "",
+		"appGuid": "",
+		"space":   "",
+		"org":     "",
+	}
+}
+
+func (au *CfAppUserGetter) CheckRoles(t messageTarget) error {
+	return checkSpaceRoles(t.Roles)
+}
+
+func (au *CfAppUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if err := au.CheckRoles(t); err != nil {
+		return nil, err
+	}
+
+	cf, err := au.client(t.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	appGuid, err := au.appGuid(t.Environment, t.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	app, err := cf.GetV3AppByGUID(appGuid)
+	if err != nil {
+		au.forgetName(t.Environment, "app", t.Id)
+		return nil, fmt.Errorf("app %s not found: %v", t.Id, err)
+	}
+
+	spaceGuid := app.Relationships["space"].Data.GUID
+	space, err := cf.GetV3SpaceByGUID(spaceGuid)
+	if err != nil {
+		return nil, fmt.Errorf("space of app %s not found: %v", t.Id, err)
+	}
+
+	org, err := cf.GetV3OrganizationByGUID(space.Relationships["organization"].Data.GUID)
+	if err != nil {
+		return nil, fmt.Errorf("org of app %s not found: %v", t.Id, err)
+	}
+
+	roles, users, err := cf.ListV3SpaceRolesByGUID(spaceGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	details := map[string]interface{}{
+		"app":     app.Name,
+		"appGuid": app.GUID,
+		"space":   space.Name,
+		"org":     org.Name,
+	}
+
+	targetUsers := cfRoleUsers(roles, users, t.Roles)
+	for i := range targetUsers {
+		targetUsers[i].Details = details
+	}
+
+	return targetUsers, nil
+}
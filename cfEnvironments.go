@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// cfEnvironments holds the CF client of every configured environment. All CF
+// target types share it.
+type cfEnvironments struct {
+	clients map[string]*cfclient.Client
+	names   *cfNameCache
+}
+
+func NewCfEnvironments(nameCacheTTL time.Duration) *cfEnvironments {
+	return &cfEnvironments{
+		clients: map[string]*cfclient.Client{},
+		names:   newCfNameCache(nameCacheTTL),
+	}
+}
+
+func (ce *cfEnvironments) RegisterEnvironment(name string, client *cfclient.Client) {
+	ce.clients[name] = client
+}
+
+func (ce *cfEnvironments) HasEnvironment(env string) bool {
+	_, ok := ce.clients[env]
+	return ok
+}
+
+func (ce *cfEnvironments) client(env string) (*cfclient.Client, error) {
+	cf, ok := ce.clients[env]
+	if !ok {
+		return nil, fmt.Errorf("Environment %v not configured\n", env)
+	}
+
+	return cf, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// CfLabelUserGetter resolves a CF label selector, like
+// "tier=prod,team in (payments,billing)", to the spaces or orgs it matches
+// and returns the users with a role in them.
+type CfLabelUserGetter struct {
+	*cfEnvironments
+}
+
+func NewCfLabelUserGetter(envs *cfEnvironments) *CfLabelUserGetter {
+	return &CfLabelUserGetter{
+		cfEnvironments: envs,
+	}
+}
+
+func (lu *CfLabelUserGetter) Get(env, selector string) ([]string, error) {
+	users, err := lu.GetTargetUsers(messageTarget{Type: "labels", Environment: env, Id: selector})
+	return targetUsernames(users), err
+}
+
+// CheckRoles checks the roles against the resource the selector picks.
+func (lu *CfLabelUserGetter) CheckRoles(t messageTarget) error {
+	switch t.Resource {
+	case "", "space":
+		return checkSpaceRoles(t.Roles)
+	case "org":
+		return checkOrgRoles(t.Roles, t.IncludeSpaces)
+	default:
+		return fmt.Errorf("invalid resource %q, use space or org", t.Resource)
+	}
+}
+
+func (lu *CfLabelUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if strings.TrimSpace(t.Id) == "" {
+		return nil, fmt.Errorf("label selector is required")
+	}
+
+	if err := lu.CheckRoles(t); err != nil {
+		return nil, err
+	}
+
+	cf, err := lu.client(t.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	query := url.Values{"label_selector": {t.Id}}
+
+	switch t.Resource {
+	case "", "space":
+		spaces, err := cf.ListV3SpacesByQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("unable to select spaces by %q: %v", t.Id, err)
+		}
+
+		var spaceGuids []string
+		for _, space := range spaces {
+			spaceGuids = append(spaceGuids, space.GUID)
+		}
+
+		roles, users, err := listCfSpaceRoles(cf, spaceGuids)
+		if err != nil {
+			return nil, err
+		}
+
+		return cfRoleUsers(roles, users, t.Roles), nil
+
+	case "org":
+		orgs, err := cf.ListV3OrganizationsByQuery(query)
+		if err != nil {
+			return nil, fmt.Errorf("unable to select orgs by %q: %v", t.Id, err)
+		}
+
+		var orgGuids []string
+		for _, org := range orgs {
+			orgGuids = append(orgGuids, org.GUID)
+		}
+
+		roles, users, err := listCfOrgRoles(cf, orgGuids)
+		if err != nil {
+			return nil, err
+		}
+
+		if t.IncludeSpaces && len(orgGuids) > 0 {
+			var spaceGuids []string
+			err := inCfGuidChunks(orgGuids, func(chunk string) error {
+				spaces, err := cf.ListV3SpacesByQuery(url.Values{"organization_guids": {chunk}})
+				for _, space := range spaces {
+					spaceGuids = append(spaceGuids, space.GUID)
+				}
+				return err
+			})
+			if err != nil {
+				return nil, err
+			}
+
+			spaceRoles, spaceUsers, err := listCfSpaceRoles(cf, spaceGuids)
+			if err != nil {
+				return nil, err
+			}
+			roles = append(roles, spaceRoles...)
+			users = append(users, spaceUsers...)
+		}
+
+		return cfRoleUsers(roles, users, t.Roles), nil
+
+	default:
+		return nil, fmt.Errorf("invalid resource %q, use space or org", t.Resource)
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cfGuidRE = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func isCfGuid(id string) bool {
+	return cfGuidRE.MatchString(id)
+}
+
+type cachedGuid struct {
+	guid    string
+	expires time.Time
+}
+
+// cfNameCache remembers the guids names were resolved to, so a script that
+// addresses a space by name doesn't cost a lookup for every message.
+type cfNameCache struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	guids map[string]cachedGuid
+}
+
+func newCfNameCache(ttl time.Duration) *cfNameCache {
+	return &cfNameCache{
+		ttl:   ttl,
+		guids: make(map[string]cachedGuid),
+	}
+}
+
+func (nc *cfNameCache) get(key string) (string, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	cached, ok := nc.guids[key]
+	if !ok || time.Now().After(cached.expires) {
+		delete(nc.guids, key)
+		return "", false
+	}
+
+	return cached.guid, true
+}
+
+func (nc *cfNameCache) set(key, guid string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.guids[key] = cachedGuid{guid: guid, expires: time.Now().Add(nc.ttl)}
+}
+
+func (nc *cfNameCache) delete(key string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	delete(nc.guids, key)
+}
+
+func cfNameCacheKey(env, kind, name string) string {
+	return env + "/" + kind + "/" + name
+}
+
+// forgetName drops the cached guid of an org, space or app name, for when
+// the guid turns out not to exist anymore. The next message looks the name
+// up again, so a deleted and recreated org, space or app is found.
+func (ce *cfEnvironments) forgetName(env, kind, name string) {
+	ce.names.delete(cfNameCacheKey(env, kind, name))
+}
+
+// orgGuid returns the guid of an org given by guid or name.
+func (ce *cfEnvironments) orgGuid(env, org string) (string, error) {
+	if isCfGuid(org) {
+		return org, nil
+	}
+
+	if org == "" || strings.Contains(org, "/") {
+		return "", fmt.Errorf("invalid org %q, use an org guid or name", org)
+	}
+
+	cacheKey := cfNameCacheKey(env, "org", org)
+	if guid, ok := ce.names.get(cacheKey); ok {
+		return guid, nil
+	}
+
+	cf, err := ce.client(env)
+	if err != nil {
+		return "", err
+	}
+
+	orgs, err := cf.ListV3OrganizationsByQuery(url.Values{"names": {org}})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(orgs) {
+	case 0:
+		return "", fmt.Errorf("org %s not found in %s", org, env)
+	case 1:
+	default:
+		return "", fmt.Errorf("org name %s is ambiguous in %s, use the org guid", org, env)
+	}
+
+	ce.names.set(cacheKey, orgs[0].GUID)
+	return orgs[0].GUID, nil
+}
+
+// appGuid returns the guid of an app given by guid or as org/space/app.
+func (ce *cfEnvironments) appGuid(env, app string) (string, error) {
+	if isCfGuid(app) {
+		return app, nil
+	}
+
+	i := strings.LastIndex(app, "/")
+	if i < 0 || strings.Count(app, "/") != 2 || app[i+1:] == "" {
+		return "", fmt.Errorf("invalid app %q, use an app guid or org/space/app", app)
+	}
+
+	cacheKey := cfNameCacheKey(env, "app", app)
+	if guid, ok := ce.names.get(cacheKey); ok {
+		return guid, nil
+	}
+
+	spaceGuid, err := ce.spaceGuid(env, app[:i])
+	if err != nil {
+		return "", err
+	}
+
+	cf, err := ce.client(env)
+	if err != nil {
+		return "", err
+	}
+
+	apps, err := cf.ListV3AppsByQuery(url.Values{"names": {app[i+1:]}, "space_guids": {spaceGuid}})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(apps) {
+	case 0:
+		return "", fmt.Errorf("app %s not found in space %s in %s", app[i+1:], app[:i], env)
+	case 1:
+	default:
+		return "", fmt.Errorf("app name %s is ambiguous in %s, use the app guid", app, env)
+	}
+
+	ce.names.set(cacheKey, apps[0].GUID)
+	return apps[0].GUID, nil
+}
+
+// spaceGuid returns the guid of a space given by guid or as org/space.
+func (ce *cfEnvironments) spaceGuid(env, space string) (string, error) {
+	if isCfGuid(space) {
+		return space, nil
+	}
+
+	parts := strings.Split(space, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", fmt.Errorf("invalid space %q, use a space guid or org/space", space)
+	}
+
+	cacheKey := cfNameCacheKey(env, "space", space)
+	if guid, ok := ce.names.get(cacheKey); ok {
+		return guid, nil
+	}
+
+	orgGuid, err := ce.orgGuid(env, parts[0])
+	if err != nil {
+		return "", err
+	}
+
+	cf, err := ce.client(env)
+	if err != nil {
+		return "", err
+	}
+
+	spaces, err := cf.ListV3SpacesByQuery(url.Values{"names": {parts[1]}, "organization_guids": {orgGuid}})
+	if err != nil {
+		return "", err
+	}
+
+	switch len(spaces) {
+	case 0:
+		return "", fmt.Errorf("space %s not found in org %s in %s", parts[1], parts[0], env)
+	case 1:
+	default:
+		return "", fmt.Errorf("space name %s is ambiguous in %s, use the space guid", space, env)
+	}
+
+	ce.names.set(cacheKey, spaces[0].GUID)
+	return spaces[0].GUID, nil
+}
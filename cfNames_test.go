@@ -0,0 +1,31 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCfNameCache(t *testing.T) {
+	nc := newCfNameCache(time.Minute)
+	key := cfNameCacheKey("prod", "space", "my-org/production")
+
+	if _, ok := nc.get(key); ok {
+		t.Fatal("empty cache returned a guid")
+	}
+
+	nc.set(key, "guid-1")
+	if guid, ok := nc.get(key); !ok || guid != "guid-1" {
+		t.Fatalf("get() = %q, %v, want guid-1, true", guid, ok)
+	}
+
+	nc.delete(key)
+	if _, ok := nc.get(key); ok {
+		t.Fatal("deleted name still cached")
+	}
+
+	expired := newCfNameCache(-time.Second)
+	expired.set(key, "guid-1")
+	if _, ok := expired.get(key); ok {
+		t.Fatal("expired name still cached")
+	}
+}
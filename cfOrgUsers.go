@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// the number of guids put in one query, to keep the url short
+const cfGuidsPerQuery = 50
+
+// inCfGuidChunks calls query with the guids, at most cfGuidsPerQuery at a time.
+func inCfGuidChunks(guids []string, query func(guids string) error) error {
+	for start := 0; start < len(guids); start += cfGuidsPerQuery {
+		end := start + cfGuidsPerQuery
+		if end > len(guids) {
+			end = len(guids)
+		}
+
+		if err := query(strings.Join(guids[start:end], ",")); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// CfOrgUserGetter resolves the users with a role in an org, and optionally
+// the members of all its spaces.
+type CfOrgUserGetter struct {
+	*cfEnvironments
+}
+
+func NewCfOrgUserGetter(envs *cfEnvironments) *CfOrgUserGetter {
+	return &CfOrgUserGetter{
+		cfEnvironments: envs,
+	}
+}
+
+func (ou *CfOrgUserGetter) Get(env, orgId string) ([]string, error) {
+	users, err := ou.GetTargetUsers(messageTarget{Type: "org", Environment: env, Id: orgId})
+	return targetUsernames(users), err
+}
+
+func (ou *CfOrgUserGetter) CheckRoles(t messageTarget) error {
+	return checkOrgRoles(t.Roles, t.IncludeSpaces)
+}
+
+func (ou *CfOrgUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if err := ou.CheckRoles(t); err != nil {
+		return nil, err
+	}
+
+	cf, err := ou.client(t.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	orgGuid, err := ou.orgGuid(t.Environment, t.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	//the role list is empty for unknown orgs, so check the org first
+	if _, err := cf.GetV3OrganizationByGUID(orgGuid); err != nil {
+		ou.forgetName(t.Environment, "org", t.Id)
+		return nil, fmt.Errorf("org %s not found: %v", t.Id, err)
+	}
+
+	roles, users, err := cf.ListV3OrganizationRolesByGUID(orgGuid)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.IncludeSpaces {
+		spaces, err := cf.ListV3SpacesByQuery(url.Values{"organization_guids": {orgGuid}})
+		if err != nil {
+			return nil, err
+		}
+
+		var spaceGuids []string
+		for _, space := range spaces {
+			spaceGuids = append(spaceGuids, space.GUID)
+		}
+
+		spaceRoles, spaceUsers, err := listCfSpaceRoles(cf, spaceGuids)
+		if err != nil {
+			return nil, err
+		}
+		roles = append(roles, spaceRoles...)
+		users = append(users, spaceUsers...)
+	}
+
+	return cfRoleUsers(roles, users, t.Roles), nil
+}
+
+// listCfSpaceRoles returns the roles in the spaces and the users holding them.
+func listCfSpaceRoles(cf *cfclient.Client, spaceGuids []string) ([]cfclient.V3Role, []cfclient.V3User, error) {
+	return listCfRoles(cf, "space_guids", spaceGuids)
+}
+
+// listCfOrgRoles returns the roles in the orgs and the users holding them.
+func listCfOrgRoles(cf *cfclient.Client, orgGuids []string) ([]cfclient.V3Role, []cfclient.V3User, error) {
+	return listCfRoles(cf, "organization_guids", orgGuids)
+}
+
+func listCfRoles(cf *cfclient.Client, filter string, guids []string) ([]cfclient.V3Role, []cfclient.V3User, error) {
+	var (
+		roles []cfclient.V3Role
+		users []cfclient.V3User
+	)
+
+	err := inCfGuidChunks(guids, func(chunk string) error {
+		chunkRoles, chunkUsers, err := cf.ListV3RoleAndUsersByQuery(url.Values{
+			filter:    {chunk},
+			"include": {"user"},
+		})
+		roles = append(roles, chunkRoles...)
+		users = append(users, chunkUsers...)
+		return err
+	})
+
+	return roles, users, err
+}
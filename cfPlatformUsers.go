@@ -0,0 +1,117 @@
+package main
+
+import (
+	"log"
+	"net/url"
+	"sort"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// CfPlatformUserGetter returns every user with an org or space role in an
+// environment, or in all environments when none is given. The users are
+// resolved org by org, so a message to a large foundation is sent while
+// the rest is still being looked up.
+type CfPlatformUserGetter struct {
+	*cfEnvironments
+}
+
+func NewCfPlatformUserGetter(envs *cfEnvironments) *CfPlatformUserGetter {
+	return &CfPlatformUserGetter{
+		cfEnvironments: envs,
+	}
+}
+
+// HasEnvironment accepts an empty environment, which means all of them.
+func (pu *CfPlatformUserGetter) HasEnvironment(env string) bool {
+	return env == "" || pu.cfEnvironments.HasEnvironment(env)
+}
+
+func (pu *CfPlatformUserGetter) Get(env, id string) ([]string, error) {
+	users, err := pu.GetTargetUsers(messageTarget{Type: "platform", Environment: env, Id: id})
+	return targetUsernames(users), err
+}
+
+// GetTargetUsers collects all pages, for dry runs.
+func (pu *CfPlatformUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	var users []targetUser
+	seen := make(map[string]int)
+
+	err := pu.StreamTargetUsers(t, func(page []targetUser) error {
+		for _, u := range page {
+			if i, ok := seen[u.Username]; ok {
+				users[i].addRoles(u.Roles...)
+				continue
+			}
+			seen[u.Username] = len(users)
+			users = append(users, u)
+		}
+		return nil
+	})
+
+	return users, err
+}
+
+func (pu *CfPlatformUserGetter) StreamTargetUsers(t messageTarget, each func([]targetUser) error) error {
+	envs := []string{t.Environment}
+	if t.Environment == "" {
+		envs = nil
+		for env := range pu.clients {
+			envs = append(envs, env)
+		}
+		sort.Strings(envs)
+	}
+
+	for _, env := range envs {
+		cf, err := pu.client(env)
+		if err != nil {
+			return err
+		}
+
+		orgs, err := cf.ListV3OrganizationsByQuery(url.Values{})
+		if err != nil {
+			return err
+		}
+
+		log.Printf("Resolving the users of %d orgs in %s\n", len(orgs), env)
+
+		for _, org := range orgs {
+			users, err := platformOrgUsers(cf, org.GUID, t.Roles)
+			if err != nil {
+				return err
+			}
+
+			if err := each(users); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// platformOrgUsers returns the users with a role in the org or any of its
+// spaces.
+func platformOrgUsers(cf *cfclient.Client, orgGuid string, filter []string) ([]targetUser, error) {
+	roles, users, err := listCfOrgRoles(cf, []string{orgGuid})
+	if err != nil {
+		return nil, err
+	}
+
+	spaces, err := cf.ListV3SpacesByQuery(url.Values{"organization_guids": {orgGuid}})
+	if err != nil {
+		return nil, err
+	}
+
+	var spaceGuids []string
+	for _, space := range spaces {
+		spaceGuids = append(spaceGuids, space.GUID)
+	}
+
+	spaceRoles, spaceUsers, err := listCfSpaceRoles(cf, spaceGuids)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfRoleUsers(append(roles, spaceRoles...), append(users, spaceUsers...), filter), nil
+}
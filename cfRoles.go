@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/cloudfoundry-community/go-cfclient"
+)
+
+// cfRoleTypes maps the role names used in targets to the CF v3 role types.
+var cfRoleTypes = map[string]string{
+	"org_user":            "organization_user",
+	"org_manager":         "organization_manager",
+	"org_auditor":         "organization_auditor",
+	"org_billing_manager": "organization_billing_manager",
+	"space_manager":       "space_manager",
+	"space_developer":     "space_developer",
+	"space_auditor":       "space_auditor",
+	"space_supporter":     "space_supporter",
+}
+
+func isCfRole(role string) bool {
+	_, ok := cfRoleTypes[role]
+	return ok
+}
+
+// checkSpaceRoles fails for roles that can't be held in a space.
+func checkSpaceRoles(roles []string) error {
+	for _, role := range roles {
+		if !strings.HasPrefix(role, "space_") {
+			return fmt.Errorf("role %s doesn't apply to spaces", role)
+		}
+	}
+
+	return nil
+}
+
+// checkOrgRoles fails for roles that can't be held in an org, or in one of
+// its spaces when they are included.
+func checkOrgRoles(roles []string, includeSpaces bool) error {
+	for _, role := range roles {
+		if strings.HasPrefix(role, "org_") || includeSpaces && strings.HasPrefix(role, "space_") {
+			continue
+		}
+
+		if strings.HasPrefix(role, "space_") {
+			return fmt.Errorf("role %s only applies to orgs with includeSpaces", role)
+		}
+		return fmt.Errorf("role %s doesn't apply to orgs", role)
+	}
+
+	return nil
+}
+
+// cfRoleName returns the target role name of a CF v3 role type.
+func cfRoleName(roleType string) string {
+	for name, t := range cfRoleTypes {
+		if t == roleType {
+			return name
+		}
+	}
+
+	return roleType
+}
+
+// cfRoleUsers returns the users holding the roles, with the roles they
+// hold. Only roles in filter are matched, unless filter is empty. Clients
+// with a role have no username and are left out.
+func cfRoleUsers(roles []cfclient.V3Role, users []cfclient.V3User, filter []string) []targetUser {
+	usernames := make(map[string]string)
+	for _, u := range users {
+		usernames[u.GUID] = u.Username
+	}
+
+	wanted := wantedRoleTypes(filter)
+
+	var result []targetUser
+	index := make(map[string]int)
+	for _, role := range roles {
+		if len(wanted) > 0 && !wanted[role.Type] {
+			continue
+		}
+
+		username := usernames[role.Relationships["user"].Data.GUID]
+		if username == "" {
+			continue
+		}
+
+		i, ok := index[username]
+		if !ok {
+			i = len(result)
+			index[username] = i
+			result = append(result, targetUser{Username: username})
+		}
+		result[i].addRoles(cfRoleName(role.Type))
+	}
+
+	return result
+}
+
+func wantedRoleTypes(filter []string) map[string]bool {
+	wanted := make(map[string]bool)
+	for _, role := range filter {
+		wanted[cfRoleTypes[role]] = true
+	}
+
+	return wanted
+}
+
+// cfSpaceMembersWith returns the users with a role in any of the spaces, and
+// gives each of them the items of their spaces as target detail. This is
+// used for targets that select spaces by what runs in them, like the
+// instances of a service.
+func cfSpaceMembersWith(cf *cfclient.Client, itemsBySpace map[string][]string, detailKey string, filter []string, details map[string]interface{}) ([]targetUser, error) {
+	var spaceGuids []string
+	for spaceGuid := range itemsBySpace {
+		spaceGuids = append(spaceGuids, spaceGuid)
+	}
+	sort.Strings(spaceGuids)
+
+	roles, users, err := listCfSpaceRoles(cf, spaceGuids)
+	if err != nil {
+		return nil, err
+	}
+
+	targetUsers := cfRoleUsers(roles, users, filter)
+
+	usernames := make(map[string]string)
+	for _, u := range users {
+		usernames[u.GUID] = u.Username
+	}
+
+	//the items of every space the user has one of the wanted roles in
+	items := make(map[string][]string)
+	wanted := wantedRoleTypes(filter)
+	for _, role := range roles {
+		if len(wanted) > 0 && !wanted[role.Type] {
+			continue
+		}
+
+		username := usernames[role.Relationships["user"].Data.GUID]
+		items[username] = mergeStrings(items[username], itemsBySpace[role.Relationships["space"].Data.GUID])
+	}
+
+	for i, tu := range targetUsers {
+		userDetails := make(map[string]interface{}, len(details)+1)
+		for k, v := range details {
+			userDetails[k] = v
+		}
+		userDetails[detailKey] = items[tu.Username]
+		targetUsers[i].Details = userDetails
+	}
+
+	return targetUsers, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestCheckRoles(t *testing.T) {
+	tests := []struct {
+		name          string
+		roles         []string
+		includeSpaces bool
+		spaceErr      bool
+		orgErr        bool
+	}{
+		{"no roles", nil, false, false, false},
+		{"space roles", []string{"space_developer", "space_manager"}, false, false, true},
+		{"space roles with includeSpaces", []string{"space_developer"}, true, false, false},
+		{"org roles", []string{"org_manager", "org_user"}, false, true, false},
+		{"org and space roles", []string{"org_manager", "space_auditor"}, true, true, false},
+		{"unknown role", []string{"admin"}, true, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkSpaceRoles(tt.roles); (err != nil) != tt.spaceErr {
+				t.Errorf("checkSpaceRoles(%v) error = %v, want error %v", tt.roles, err, tt.spaceErr)
+			}
+			if err := checkOrgRoles(tt.roles, tt.includeSpaces); (err != nil) != tt.orgErr {
+				t.Errorf("checkOrgRoles(%v, %v) error = %v, want error %v", tt.roles, tt.includeSpaces, err, tt.orgErr)
+			}
+		})
+	}
+}
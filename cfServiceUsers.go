@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// CfServiceUserGetter resolves a service offering, optionally limited to one
+// plan, to the members of every space that has an instance of it. Every
+// recipient gets the names of the instances in their spaces as target
+// detail.
+type CfServiceUserGetter struct {
+	*cfEnvironments
+}
+
+func NewCfServiceUserGetter(envs *cfEnvironments) *CfServiceUserGetter {
+	return &CfServiceUserGetter{
+		cfEnvironments: envs,
+	}
+}
+
+func (su *CfServiceUserGetter) Get(env, service string) ([]string, error) {
+	users, err := su.GetTargetUsers(messageTarget{Type: "service", Environment: env, Id: service})
+	return targetUsernames(users), err
+}
+
+func (su *CfServiceUserGetter) TargetDetails() map[string]interface{} {
+	return map[string]interface{}{
+		"service":   "",
+		"plan":      "",
+		"instances": []string{},
+	}
+}
+
+func (su *CfServiceUserGetter) CheckRoles(t messageTarget) error {
+	return checkSpaceRoles(t.Roles)
+}
+
+func (su *CfServiceUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if err := su.CheckRoles(t); err != nil {
+		return nil, err
+	}
+
+	cf, err := su.client(t.Environment)
+	if err != nil {
+		return nil, err
+	}
+
+	//an offering can be registered by several brokers under the same name
+	services, err := cf.ListServicesByQuery(url.Values{"q": {"label:" + t.Id}})
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, fmt.Errorf("service offering %s not found in %s", t.Id, t.Environment)
+	}
+
+	var planGuids []string
+	for _, service := range services {
+		plans, err := cf.ListServicePlansByQuery(url.Values{"q": {"service_guid:" + service.Guid}})
+		if err != nil {
+			return nil, err
+		}
+
+		for _, plan := range plans {
+			if t.Plan == "" || plan.Name == t.Plan {
+				planGuids = append(planGuids, plan.Guid)
+			}
+		}
+	}
+	if len(planGuids) == 0 {
+		return nil, fmt.Errorf("plan %s of service offering %s not found in %s", t.Plan, t.Id, t.Environment)
+	}
+
+	instancesBySpace := make(map[string][]string)
+	err = inCfGuidChunks(planGuids, func(chunk string) error {
+		instances, err := cf.ListV3ServiceInstancesByQuery(url.Values{"service_plan_guids": {chunk}})
+		for _, instance := range instances {
+			spaceGuid := instance.Relationships["space"].Data.GUID
+			instancesBySpace[spaceGuid] = append(instancesBySpace[spaceGuid], instance.Name)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(instancesBySpace) == 0 {
+		return []targetUser{}, nil
+	}
+
+	return cfSpaceMembersWith(cf, instancesBySpace, "instances", t.Roles, map[string]interface{}{
+		"service": t.Id,
+		"plan":    t.Plan,
+	})
+}
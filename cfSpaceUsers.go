@@ -2,45 +2,51 @@ package main
 
 import (
 	"fmt"
-
-	"github.com/cloudfoundry-community/go-cfclient"
 )
 
 type CfSpaceUserGetter struct {
-	cfEnvs map[string]*cfclient.Client
+	*cfEnvironments
 }
 
-func NewCfSpaceUserGetter() *CfSpaceUserGetter {
+func NewCfSpaceUserGetter(envs *cfEnvironments) *CfSpaceUserGetter {
 	return &CfSpaceUserGetter{
-		cfEnvs: map[string]*cfclient.Client{},
+		cfEnvironments: envs,
 	}
 }
 
-func (su *CfSpaceUserGetter) RegisterEnvironment(name string, client *cfclient.Client) {
-	su.cfEnvs[name] = client
+func (su *CfSpaceUserGetter) Get(env, spaceId string) ([]string, error) {
+	users, err := su.GetTargetUsers(messageTarget{Type: "space", Environment: env, Id: spaceId})
+	return targetUsernames(users), err
 }
 
-func (su *CfSpaceUserGetter) Get(env, spaceId string) ([]string, error) {
-	cf, ok := su.cfEnvs[env]
-	if !ok {
-		return nil, fmt.Errorf("Environment %v not configured\n", env)
+func (su *CfSpaceUserGetter) CheckRoles(t messageTarget) error {
+	return checkSpaceRoles(t.Roles)
+}
+
+func (su *CfSpaceUserGetter) GetTargetUsers(t messageTarget) ([]targetUser, error) {
+	if err := su.CheckRoles(t); err != nil {
+		return nil, err
 	}
 
-	space, err := cf.GetSpaceByGuid(spaceId)
+	cf, err := su.client(t.Environment)
 	if err != nil {
 		return nil, err
 	}
 
-	var users []string
-
-	roles, err := space.Roles()
+	spaceGuid, err := su.spaceGuid(t.Environment, t.Id)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, user := range roles {
-		users = append(users, user.Username)
+	if _, err := cf.GetV3SpaceByGUID(spaceGuid); err != nil {
+		su.forgetName(t.Environment, "space", t.Id)
+		return nil, fmt.Errorf("space %s not found: %v", t.Id, err)
+	}
+
+	roles, users, err := cf.ListV3SpaceRolesByGUID(spaceGuid)
+	if err != nil {
+		return nil, err
 	}
 
-	return users, nil
+	return cfRoleUsers(roles, users, t.Roles), nil
 }
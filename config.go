@@ -1,8 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"io/ioutil"
 	"log"
+	"time"
 
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/kelseyhightower/envconfig"
@@ -15,6 +17,8 @@ type notificationServerConfig struct {
 	CFClient   map[string]string `envconfig:"cf_client"`
 	CFSecret   map[string]string `envconfig:"cf_secret"`
 
+	CFNameCacheTTL time.Duration `envconfig:"cf_name_cache_ttl" default:"10m"`
+
 	EmailHost     string `envconfig:"email_host" required:"true"`
 	EmailPort     int    `envconfig:"email_port" required:"true"`
 	EmailFrom     string `envconfig:"email_from" required:"true"`
@@ -35,9 +39,47 @@ type notificationServerConfig struct {
 	RabbitTemplateFiles map[string]string `envconfig:"rabbit_template_files" required:"false"`
 	//RabbitRoutingKeys   []string          `envconfig:"rabbit_routinkeys" required:"false"`
 	RabbitTemplates map[string]string
+	RabbitFormats   map[string]string `envconfig:"rabbit_formats" required:"false"`
 
 	ApiUsers map[string]string `envconfig:"api_users" required:"true"`
 
+	TemplateFiles map[string]string `envconfig:"template_files" required:"false"`
+
+	DeliveryWorkers      int           `envconfig:"delivery_workers" default:"4"`
+	DeliveryMaxAttempts  int           `envconfig:"delivery_max_attempts" default:"5"`
+	DeliveryTimeout      time.Duration `envconfig:"delivery_timeout" default:"30s"`
+	DeliveryRetryDelay   time.Duration `envconfig:"delivery_retry_delay" default:"10s"`
+	DeliveryPollInterval time.Duration `envconfig:"delivery_poll_interval" default:"1s"`
+
+	SchedulerPollInterval time.Duration `envconfig:"scheduler_poll_interval" default:"10s"`
+
+	DigestDailyAt       string        `envconfig:"digest_daily_at" default:"08:00"`
+	DigestPollInterval  time.Duration `envconfig:"digest_poll_interval" default:"1m"`
+	DigestDailyAtOffset time.Duration `ignored:"true"`
+
+	DeliveryReportRetention time.Duration `envconfig:"delivery_report_retention" default:"168h"`
+	DefaultValidity         time.Duration `envconfig:"default_validity" default:"24h"`
+	BatchMaxMessages        int           `envconfig:"batch_max_messages" default:"500"`
+
+	RateLimitApiUser  string            `envconfig:"rate_limit_api_user" required:"false"`
+	RateLimitApiUsers map[string]string `envconfig:"rate_limit_api_users" required:"false"`
+	RateLimitTarget   string            `envconfig:"rate_limit_target" required:"false"`
+
+	ApiUserRateLimit  rateLimit            `ignored:"true"`
+	ApiUsersRateLimit map[string]rateLimit `ignored:"true"`
+	TargetRateLimit   rateLimit            `ignored:"true"`
+
+	QuietHoursOverrideUsers []string `envconfig:"quiet_hours_override_users" required:"false"`
+
+	AckSecret        string        `envconfig:"ack_secret" required:"false"`
+	AckBaseURL       string        `envconfig:"ack_base_url" required:"false"`
+	AckAddressTypes  []string      `envconfig:"ack_address_types" default:"email"`
+	AckEscalateAfter time.Duration `envconfig:"ack_escalate_after" default:"15m"`
+	AckPollInterval  time.Duration `envconfig:"ack_poll_interval" default:"10s"`
+	RabbitAckQueue   string        `envconfig:"rabbit_ack_queue" required:"false"`
+
+	ActionURLSchemes []string `envconfig:"action_url_schemes" default:"https,http"`
+
 	ClientID         string `envconfig:"CLIENT_ID" required:"true"`
 	ClientSecret     string `envconfig:"CLIENT_SECRET" required:"true"`
 	OauthProviderUrl string `envconfig:"OAUTH_PROVIDER_URL" required:"true"` //"https://uaa.sys.cf.automate-it.lab/oauth/token"
@@ -102,6 +144,41 @@ func notificationServerConfigLoad() (notificationServerConfig, error) {
 			}
 			config.RabbitTemplates[providerName] = string(inBuf)
 		}
+
+		for providerName, format := range config.RabbitFormats {
+			if format != formatText && format != formatMarkdown {
+				return notificationServerConfig{}, fmt.Errorf("invalid format %s for %s, use text or markdown", format, providerName)
+			}
+		}
+	}
+
+	//ack links are signed with the session key when no separate secret is set
+	if config.AckSecret == "" {
+		config.AckSecret = config.SessionKey
+	}
+
+	dailyAt, err := time.Parse("15:04", config.DigestDailyAt)
+	if err != nil {
+		return notificationServerConfig{}, fmt.Errorf("invalid DIGEST_DAILY_AT %s, use hh:mm", config.DigestDailyAt)
+	}
+	config.DigestDailyAtOffset = time.Duration(dailyAt.Hour())*time.Hour + time.Duration(dailyAt.Minute())*time.Minute
+
+	config.ApiUserRateLimit, err = parseRateLimit(config.RateLimitApiUser)
+	if err != nil {
+		return notificationServerConfig{}, err
+	}
+
+	config.ApiUsersRateLimit = make(map[string]rateLimit)
+	for apiUser, limit := range config.RateLimitApiUsers {
+		config.ApiUsersRateLimit[apiUser], err = parseRateLimit(limit)
+		if err != nil {
+			return notificationServerConfig{}, err
+		}
+	}
+
+	config.TargetRateLimit, err = parseRateLimit(config.RateLimitTarget)
+	if err != nil {
+		return notificationServerConfig{}, err
 	}
 
 	return config, nil
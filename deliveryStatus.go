@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	deliveryQueued   = "queued"
+	deliverySent     = "sent"
+	deliveryFailed   = "failed"
+	deliverySkipped  = "skipped"
+	deliveryDigest   = "digest"
+	deliveryDeferred = "deferred"
+)
+
+type deliveryStatus struct {
+	Username    string    `json:"username"`
+	AddressType string    `json:"addressType,omitempty"`
+	Roles       []string  `json:"roles,omitempty"`
+	Status      string    `json:"status"`
+	Error       string    `json:"error,omitempty"`
+	Attempts    int       `json:"attempts"`
+	UpdatedAt   time.Time `json:"updatedAt"`
+}
+
+func (ds deliveryStatus) MarshalBinary() ([]byte, error) {
+	return json.Marshal(ds)
+}
+
+type deliveryReport struct {
+	MessageId  string           `json:"messageId"`
+	Deliveries []deliveryStatus `json:"deliveries"`
+}
+
+func deliveryStatusKey(messageId string) string {
+	return "deliveries-" + messageId
+}
+
+// recordDeliveryStatus stores the outcome for one recipient address of a
+// message. Skipped recipients have no address type.
+func (ns *notificationServer) recordDeliveryStatus(ctx context.Context, messageId string, ds deliveryStatus) {
+	ds.UpdatedAt = time.Now()
+	key := deliveryStatusKey(messageId)
+
+	_, err := ns.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, key, ds.Username+"/"+ds.AddressType, ds)
+		pipe.Expire(ctx, key, ns.deliveryReportRetention)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Unable to record delivery status for %s: %v\n", messageId, err)
+	}
+}
+
+// recordDelivery records the status of a delivery. A digest records it for
+// every message it combines.
+func (ns *notificationServer) recordDelivery(ctx context.Context, d delivery, status string) {
+	ds := deliveryStatus{
+		Username:    d.Username,
+		AddressType: d.AddressType,
+		Roles:       d.Roles,
+		Status:      status,
+		Error:       d.LastError,
+		Attempts:    d.Attempts,
+	}
+
+	if len(d.Digest) == 0 {
+		ns.recordDeliveryStatus(ctx, d.MessageKey, ds)
+		return
+	}
+
+	for _, messageKey := range d.Digest {
+		ns.recordDeliveryStatus(ctx, messageKey, ds)
+	}
+}
+
+func (ns *notificationServer) getDeliveryReport(ctx context.Context, messageId string) (deliveryReport, error) {
+	report := deliveryReport{
+		MessageId:  messageId,
+		Deliveries: []deliveryStatus{},
+	}
+
+	statuses, err := ns.redisClient.HGetAll(ctx, deliveryStatusKey(messageId)).Result()
+	if err != nil {
+		return report, err
+	}
+
+	for _, statusString := range statuses {
+		var ds deliveryStatus
+		if err := json.Unmarshal([]byte(statusString), &ds); err != nil {
+			log.Println(err)
+			continue
+		}
+		report.Deliveries = append(report.Deliveries, ds)
+	}
+
+	sort.Slice(report.Deliveries, func(i, j int) bool {
+		if report.Deliveries[i].Username != report.Deliveries[j].Username {
+			return report.Deliveries[i].Username < report.Deliveries[j].Username
+		}
+		return report.Deliveries[i].AddressType < report.Deliveries[j].AddressType
+	})
+
+	return report, nil
+}
+
+func (ns *notificationServer) deliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	messageId := mux.Vars(r)["id"]
+
+	report, err := ns.getDeliveryReport(r.Context(), messageId)
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	if len(report.Deliveries) == 0 {
+		writeError(w, newApiError(http.StatusNotFound, errMessageNotFound, "no deliveries found for message %s", messageId))
+		return
+	}
+
+	writeData(w, http.StatusOK, report)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const maxDeliveryRetryDelay = time.Hour
+
+type delivery struct {
+	Id           string       `json:"id"`
+	MessageKey   string       `json:"messageKey"`
+	Username     string       `json:"username"`
+	AddressType  string       `json:"addressType"`
+	Address      string       `json:"address"`
+	Notification notification `json:"notification"`
+	Attempts     int          `json:"attempts"`
+	LastError    string       `json:"lastError,omitempty"`
+	QueuedAt     time.Time    `json:"queuedAt"`
+	Digest       []string     `json:"digest,omitempty"`
+	Roles        []string     `json:"roles,omitempty"`
+}
+
+func (d delivery) MarshalBinary() ([]byte, error) {
+	return json.Marshal(d)
+}
+
+func newDelivery(messageKey, username, addressType, address string, n notification) delivery {
+	return delivery{
+		Id:           fmt.Sprintf("%s/%s/%s", messageKey, username, addressType),
+		MessageKey:   messageKey,
+		Username:     username,
+		AddressType:  addressType,
+		Address:      address,
+		Notification: n,
+		QueuedAt:     time.Now(),
+	}
+}
+
+func (ns *notificationServer) enqueueDelivery(ctx context.Context, d delivery) error {
+	if err := ns.deliveryQueue.Add(ctx, d.Id, d, time.Now()); err != nil {
+		return err
+	}
+
+	ns.recordDelivery(ctx, d, deliveryQueued)
+	return nil
+}
+
+// StartDeliveryWorkers starts the pool of workers that process the delivery
+// queue until ctx is cancelled.
+func (ns *notificationServer) StartDeliveryWorkers(ctx context.Context, workers int) {
+	for i := 0; i < workers; i++ {
+		go ns.deliveryWorker(ctx)
+	}
+}
+
+func (ns *notificationServer) deliveryWorker(ctx context.Context) {
+	//the lease must outlast a delivery attempt, otherwise another worker picks it up while we're still sending
+	lease := 2 * ns.deliveryTimeout
+
+	ns.deliveryQueue.Consume(ctx, lease, ns.deliveryPollInterval, func(ctx context.Context, id string, payload []byte) {
+		var d delivery
+		if err := json.Unmarshal(payload, &d); err != nil {
+			log.Printf("Dropping unreadable delivery %s: %v\n", id, err)
+			ns.deliveryQueue.Remove(ctx, id)
+			return
+		}
+
+		ns.processDelivery(ctx, d)
+	})
+}
+
+func (ns *notificationServer) processDelivery(ctx context.Context, d delivery) {
+	sender, ok := ns.notificationSenders[d.AddressType]
+	if !ok {
+		log.Printf("Address type %s not valid, dropping delivery %s\n", d.AddressType, d.Id)
+		ns.deliveryQueue.Remove(ctx, d.Id)
+		d.LastError = "address type not supported"
+		ns.recordDelivery(ctx, d, deliveryFailed)
+		return
+	}
+
+	d.Attempts++
+	err := sendWithTimeout(sender, d, ns.deliveryTimeout)
+	if err == nil {
+		if err := ns.deliveryQueue.Remove(ctx, d.Id); err != nil {
+			log.Println(err)
+		}
+		d.LastError = ""
+		ns.recordDelivery(ctx, d, deliverySent)
+
+		_, err := ns.redisClient.Do(ctx, "HINCRBY", "counters", d.AddressType, 1).Result()
+		if err != nil {
+			log.Println(err)
+		}
+
+		_, err = ns.redisClient.Do(ctx, "HINCRBY", "counters-severity", d.Notification.Severity, 1).Result()
+		if err != nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	d.LastError = err.Error()
+	if d.Attempts >= ns.deliveryMaxAttempts {
+		log.Printf("Giving up on delivery %s after %d attempts: %v\n", d.Id, d.Attempts, err)
+		ns.deliveryQueue.Remove(ctx, d.Id)
+		ns.recordDelivery(ctx, d, deliveryFailed)
+		return
+	}
+
+	delay := retryDelay(ns.deliveryRetryDelay, d.Attempts)
+	log.Printf("Delivery %s failed (attempt %d), retrying in %v: %v\n", d.Id, d.Attempts, delay, err)
+	if err := ns.deliveryQueue.Add(ctx, d.Id, d, time.Now().Add(delay)); err != nil {
+		log.Println(err)
+	}
+	ns.recordDelivery(ctx, d, deliveryQueued)
+}
+
+// retryDelay doubles the base delay for every failed attempt.
+func retryDelay(base time.Duration, attempts int) time.Duration {
+	delay := base
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= maxDeliveryRetryDelay {
+			return maxDeliveryRetryDelay
+		}
+	}
+
+	return delay
+}
+
+// sendWithTimeout stops waiting for the sender after the timeout. The senders
+// can't be cancelled, so a timed out send may still complete in the background.
+func sendWithTimeout(sender NotificationSender, d delivery, timeout time.Duration) error {
+	result := make(chan error, 1)
+	go func() {
+		result <- sender.Send(d.Address, d.Notification)
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(timeout):
+		return fmt.Errorf("delivery timed out after %v", timeout)
+	}
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// delivery modes a subscriber can choose per address type
+const (
+	digestImmediate = "immediate"
+	digestHourly    = "hourly"
+	digestDaily     = "daily"
+)
+
+var severityRank = map[string]int{
+	severityInfo:     0,
+	severityWarning:  1,
+	severityCritical: 2,
+}
+
+func isDigestMode(mode string) bool {
+	return mode == digestImmediate || mode == digestHourly || mode == digestDaily
+}
+
+// digestEntry is a notification waiting in the digest of a subscriber.
+type digestEntry struct {
+	MessageKey   string       `json:"messageKey"`
+	Notification notification `json:"notification"`
+	QueuedAt     time.Time    `json:"queuedAt"`
+}
+
+func (e digestEntry) MarshalBinary() ([]byte, error) {
+	return json.Marshal(e)
+}
+
+type pendingDigest struct {
+	Username    string `json:"username"`
+	AddressType string `json:"addressType"`
+}
+
+func (p pendingDigest) MarshalBinary() ([]byte, error) {
+	return json.Marshal(p)
+}
+
+func digestKey(username, addressType string) string {
+	return "digest-" + username + "/" + addressType
+}
+
+// DigestMode returns how notifications for an address type are delivered.
+func (s Subscription) DigestMode(addressType string) string {
+	if mode, ok := s.Delivery[addressType]; ok && isDigestMode(mode) {
+		return mode
+	}
+
+	return digestImmediate
+}
+
+// IsDigested tells if the notification goes into the digest of an address
+// type instead of being delivered right away.
+func (s Subscription) IsDigested(addressType string, n notification) bool {
+	if s.DigestMode(addressType) == digestImmediate || n.RequireAck {
+		return false
+	}
+
+	return !(s.CriticalImmediate && n.Severity == severityCritical)
+}
+
+// nextDigestTime returns when the digest of the given mode is sent next.
+// Daily digests are sent at dailyAt after midnight, local time.
+func nextDigestTime(mode string, now time.Time, dailyAt time.Duration) time.Time {
+	if mode == digestHourly {
+		return time.Date(now.Year(), now.Month(), now.Day(), now.Hour(), 0, 0, 0, now.Location()).Add(time.Hour)
+	}
+
+	//dailyAt is counted on the clock, so the digest keeps its time on the days the clocks change
+	next := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, int(dailyAt), now.Location())
+	if !next.After(now) {
+		next = time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, int(dailyAt), now.Location())
+	}
+
+	return next
+}
+
+// bufferDigest adds the notification to the digest of the user and makes
+// sure the digest is sent on schedule.
+func (ns *notificationServer) bufferDigest(ctx context.Context, messageKey, username, addressType, mode string, n notification) error {
+	entry := digestEntry{
+		MessageKey:   messageKey,
+		Notification: n,
+		QueuedAt:     time.Now(),
+	}
+
+	if err := ns.redisClient.RPush(ctx, digestKey(username, addressType), entry).Err(); err != nil {
+		return err
+	}
+
+	due := nextDigestTime(mode, time.Now(), ns.digestDailyAt)
+	id := username + "/" + addressType
+	//the first entry of a digest sets when it is sent, later ones don't postpone it
+	return ns.digestQueue.AddNX(ctx, id, pendingDigest{Username: username, AddressType: addressType}, due)
+}
+
+// StartDigests sends the digests when they are due until ctx is cancelled.
+func (ns *notificationServer) StartDigests(ctx context.Context, pollInterval time.Duration) {
+	go ns.digestQueue.Consume(ctx, queueLease, pollInterval, ns.flushDigest)
+}
+
+// flushDigest combines the buffered notifications of a user into one and
+// queues it for delivery.
+func (ns *notificationServer) flushDigest(ctx context.Context, id string, payload []byte) {
+	var pd pendingDigest
+	if err := json.Unmarshal(payload, &pd); err != nil {
+		log.Printf("Dropping unreadable digest %s: %v\n", id, err)
+		ns.digestQueue.Remove(ctx, id)
+		return
+	}
+
+	//remove the schedule before taking the entries, entries added from now on schedule a new digest
+	if err := ns.digestQueue.Remove(ctx, id); err != nil {
+		log.Println(err)
+		return
+	}
+
+	entries, err := ns.takeDigestEntries(ctx, pd.Username, pd.AddressType)
+	if err != nil {
+		log.Printf("Unable to read digest %s: %v\n", id, err)
+		//try again later
+		if err := ns.digestQueue.Add(ctx, id, pd, time.Now().Add(queueLease)); err != nil {
+			log.Println(err)
+		}
+		return
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	var messageKeys []string
+	for _, entry := range entries {
+		messageKeys = append(messageKeys, entry.MessageKey)
+	}
+
+	skip := func(reason string) {
+		for _, key := range messageKeys {
+			ns.recordDeliveryStatus(ctx, key, deliveryStatus{Username: pd.Username, AddressType: pd.AddressType, Status: deliverySkipped, Error: reason})
+		}
+	}
+
+	//the address is looked up now, the user may have changed it since the notifications arrived
+	ci, err := ns.getSubscription(ctx, pd.Username)
+	if err != nil {
+		skip("no subscription")
+		return
+	}
+
+	address := ci.Addresses[pd.AddressType]
+	if address == "" {
+		skip("address removed")
+		return
+	}
+
+	log.Printf("Sending digest of %d notifications to %s\n", len(entries), id)
+
+	messageKey := "digest/" + strconv.FormatInt(time.Now().UnixMilli(), 10)
+	d := newDelivery(messageKey, pd.Username, pd.AddressType, address, digestNotification(entries))
+	d.Digest = messageKeys
+
+	if err := ns.queueDelivery(ctx, ci, d); err != nil {
+		log.Printf("Unable to queue digest %s: %v\n", id, err)
+		skip("unable to queue digest")
+	}
+}
+
+// takeDigestEntries returns and removes the buffered notifications of a user.
+func (ns *notificationServer) takeDigestEntries(ctx context.Context, username, addressType string) ([]digestEntry, error) {
+	key := digestKey(username, addressType)
+
+	var lrange *redis.StringSliceCmd
+	_, err := ns.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		lrange = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []digestEntry
+	for _, entryString := range lrange.Val() {
+		var entry digestEntry
+		if err := json.Unmarshal([]byte(entryString), &entry); err != nil {
+			log.Println(err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// digestNotification combines notifications into one markdown notification.
+// Updates and resolves are grouped with the message they follow up on.
+func digestNotification(entries []digestEntry) notification {
+	var (
+		threads  []string
+		grouped  = make(map[string][]digestEntry)
+		severity = severityInfo
+	)
+
+	for _, entry := range entries {
+		thread := entry.Notification.Thread
+		if thread == "" {
+			thread = entry.MessageKey
+		}
+
+		if _, ok := grouped[thread]; !ok {
+			threads = append(threads, thread)
+		}
+		grouped[thread] = append(grouped[thread], entry)
+
+		if severityRank[entry.Notification.Severity] > severityRank[severity] {
+			severity = entry.Notification.Severity
+		}
+	}
+
+	var out strings.Builder
+	for _, thread := range threads {
+		threadEntries := grouped[thread]
+		fmt.Fprintf(&out, "## %s\n\n", threadEntries[0].Notification.Subject)
+
+		for _, entry := range threadEntries {
+			n := entry.Notification
+			fmt.Fprintf(&out, "**%s** (%s, %s)\n\n", n.Subject, n.Severity, entry.QueuedAt.Local().Format("Jan 2 15:04"))
+			fmt.Fprintf(&out, "%s\n\n", strings.TrimSpace(n.Message))
+
+			if len(n.Actions) > 0 {
+				var links []string
+				for _, a := range n.Actions {
+					links = append(links, fmt.Sprintf("[%s](%s)", a.Label, a.URL))
+				}
+				fmt.Fprintf(&out, "%s\n\n", strings.Join(links, " | "))
+			}
+		}
+	}
+
+	subject := fmt.Sprintf("Digest: %d notifications", len(entries))
+	if len(entries) == 1 {
+		subject = "Digest: 1 notification"
+	}
+
+	return notification{
+		Subject:  subject,
+		Message:  strings.TrimSpace(out.String()),
+		Format:   formatMarkdown,
+		Severity: severity,
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextDigestTime(t *testing.T) {
+	ams, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		mode    string
+		now     time.Time
+		dailyAt time.Duration
+		want    time.Time
+	}{
+		{"hourly", digestHourly, time.Date(2023, 6, 1, 10, 20, 0, 0, ams), 0, time.Date(2023, 6, 1, 11, 0, 0, 0, ams)},
+		{"hourly on the hour", digestHourly, time.Date(2023, 6, 1, 10, 0, 0, 0, ams), 0, time.Date(2023, 6, 1, 11, 0, 0, 0, ams)},
+		{"hourly before midnight", digestHourly, time.Date(2023, 6, 1, 23, 30, 0, 0, ams), 0, time.Date(2023, 6, 2, 0, 0, 0, 0, ams)},
+		{"daily later today", digestDaily, time.Date(2023, 6, 1, 6, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 6, 1, 8, 0, 0, 0, ams)},
+		{"daily at the time", digestDaily, time.Date(2023, 6, 1, 8, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 6, 2, 8, 0, 0, 0, ams)},
+		{"daily tomorrow", digestDaily, time.Date(2023, 6, 1, 9, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 6, 2, 8, 0, 0, 0, ams)},
+		{"daily at midnight", digestDaily, time.Date(2023, 6, 1, 9, 0, 0, 0, ams), 0, time.Date(2023, 6, 2, 0, 0, 0, 0, ams)},
+		{"daily with minutes", digestDaily, time.Date(2023, 6, 1, 9, 0, 0, 0, ams), 17*time.Hour + 30*time.Minute, time.Date(2023, 6, 1, 17, 30, 0, 0, ams)},
+		{"daily at the end of the month", digestDaily, time.Date(2023, 6, 30, 9, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 7, 1, 8, 0, 0, 0, ams)},
+		{"daily when dst starts", digestDaily, time.Date(2023, 3, 25, 9, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 3, 26, 8, 0, 0, 0, ams)},
+		{"daily when dst ends", digestDaily, time.Date(2023, 10, 28, 9, 0, 0, 0, ams), 8 * time.Hour, time.Date(2023, 10, 29, 8, 0, 0, 0, ams)},
+		{"hourly when dst ends", digestHourly, time.Date(2023, 10, 29, 2, 30, 0, 0, ams), 0, time.Date(2023, 10, 29, 2, 30, 0, 0, ams).Add(30 * time.Minute)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := nextDigestTime(tt.mode, tt.now, tt.dailyAt); !got.Equal(tt.want) {
+				t.Errorf("nextDigestTime(%s, %v, %v) = %v, want %v", tt.mode, tt.now, tt.dailyAt, got, tt.want)
+			}
+		})
+	}
+}
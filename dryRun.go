@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// dryRunReport tells who would be notified of a message, without sending it.
+type dryRunReport struct {
+	Key          string            `json:"key"`
+	Duplicate    bool              `json:"duplicate"`
+	Original     *sendResult       `json:"original,omitempty"`
+	Targets      []targetResult    `json:"targets"`
+	Recipients   []dryRunRecipient `json:"recipients"`
+	Subscribed   int               `json:"subscribed"`
+	AddressTypes map[string]int    `json:"addressTypes"`
+}
+
+type dryRunRecipient struct {
+	Username     string                 `json:"username"`
+	Roles        []string               `json:"roles,omitempty"`
+	Target       map[string]interface{} `json:"target,omitempty"`
+	Subscribed   bool                   `json:"subscribed"`
+	AddressTypes []string               `json:"addressTypes,omitempty"`
+}
+
+// dryRun runs the same checks and lookups as a send but doesn't store or
+// queue anything.
+func (ns *notificationServer) dryRun(ctx context.Context, msg messageBody) (dryRunReport, error) {
+	report := dryRunReport{
+		Key:          msg.Key(),
+		Recipients:   []dryRunRecipient{},
+		AddressTypes: make(map[string]int),
+	}
+
+	original, err := ns.getMessage(ctx, report.Key)
+	if err == nil {
+		result := ns.getSendResult(ctx, original, true)
+		report.Duplicate = true
+		report.Original = &result
+	} else if err != redis.Nil {
+		log.Println(err)
+	}
+
+	users, targets, err := ns.resolveTargets(msg)
+	report.Targets = targets
+	if err != nil {
+		return report, err
+	}
+
+	for _, u := range users {
+		recipient := dryRunRecipient{Username: u.Username, Roles: u.Roles, Target: u.Details}
+
+		ci, err := ns.getSubscription(ctx, u.Username)
+		if err == nil {
+			for addressType, address := range ci.Addresses {
+				if _, ok := ns.notificationSenders[addressType]; ok && address != "" {
+					recipient.AddressTypes = append(recipient.AddressTypes, addressType)
+					report.AddressTypes[addressType]++
+				}
+			}
+			sort.Strings(recipient.AddressTypes)
+		}
+
+		recipient.Subscribed = len(recipient.AddressTypes) > 0
+		if recipient.Subscribed {
+			report.Subscribed++
+		}
+
+		report.Recipients = append(report.Recipients, recipient)
+	}
+
+	sort.Slice(report.Recipients, func(i, j int) bool {
+		return report.Recipients[i].Username < report.Recipients[j].Username
+	})
+
+	return report, nil
+}
@@ -1,14 +1,38 @@
 package main
 
 import (
+	"crypto/sha1"
 	"crypto/tls"
+	"encoding/hex"
 	"fmt"
+	"html"
 	"log"
 	"regexp"
+	"strings"
 
 	"gopkg.in/gomail.v2"
 )
 
+var (
+	emailSubjectPrefix = map[string]string{
+		severityInfo:     "",
+		severityWarning:  "[WARNING] ",
+		severityCritical: "[CRITICAL] ",
+	}
+
+	emailPriority = map[string]string{
+		severityInfo:     "3 (Normal)",
+		severityWarning:  "2 (High)",
+		severityCritical: "1 (Highest)",
+	}
+
+	emailImportance = map[string]string{
+		severityInfo:     "normal",
+		severityWarning:  "high",
+		severityCritical: "high",
+	}
+)
+
 type emailSender struct {
 	From         string
 	mailClient   *gomail.Dialer
@@ -23,18 +47,45 @@ func NewEmailSender(host string, port int, from string) *emailSender {
 	}
 }
 
-func (e *emailSender) Send(dest, subject, message string) error {
+func (e *emailSender) Send(dest string, n notification) error {
 	if dest == "" {
 		return fmt.Errorf("No destination address given")
 	}
 
-	log.Printf("sending message to %s. Subject: %v, message: %v\n", dest, subject, message)
+	log.Printf("sending message to %s. Subject: %v, message: %v\n", dest, n.Subject, n.Message)
 
 	m := gomail.NewMessage()
 	m.SetHeader("From", e.From)
 	m.SetHeader("To", dest)
-	m.SetHeader("Subject", subject)
-	m.SetBody("text/plain", message)
+	m.SetHeader("Subject", emailSubjectPrefix[n.Severity]+n.Subject)
+	m.SetHeader("X-Priority", emailPriority[n.Severity])
+	m.SetHeader("Importance", emailImportance[n.Severity])
+
+	//thread follow-ups with the original message
+	if n.Thread != "" {
+		threadId := e.messageId(n.Thread)
+		if n.FollowUp == "" {
+			m.SetHeader("Message-ID", threadId)
+		} else {
+			m.SetHeader("Message-ID", e.messageId(n.Thread+"/"+n.FollowUp))
+			m.SetHeader("In-Reply-To", threadId)
+			m.SetHeader("References", threadId)
+		}
+	}
+
+	var ackText, ackHTML string
+	if n.AckURL != "" {
+		ackText = "\n\nPlease acknowledge that you have seen this message: " + n.AckURL
+		ackHTML = fmt.Sprintf("<p><a href=\"%s\">Acknowledge that you have seen this message</a></p>\n", html.EscapeString(n.AckURL))
+	}
+
+	//actions are shown as buttons, so messages with actions get an html version too
+	if n.Format == formatMarkdown || len(n.Actions) > 0 {
+		m.SetBody("text/plain", n.PlainText()+n.ActionsText()+ackText)
+		m.AddAlternative("text/html", "<html><body>\n"+n.HTML()+n.ActionsHTML()+ackHTML+"</body></html>")
+	} else {
+		m.SetBody("text/plain", n.Message+ackText)
+	}
 
 	if err := e.mailClient.DialAndSend(m); err != nil {
 		log.Println("Unable to send mail: ", err)
@@ -44,6 +95,18 @@ func (e *emailSender) Send(dest, subject, message string) error {
 	return nil
 }
 
+// messageId derives a stable Message-ID from a message key, so follow-ups can
+// refer to the original message.
+func (e *emailSender) messageId(key string) string {
+	domain := "localhost"
+	if at := strings.LastIndex(e.From, "@"); at >= 0 {
+		domain = strings.TrimRight(e.From[at+1:], "> ")
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return fmt.Sprintf("<%s@%s>", hex.EncodeToString(sum[:]), domain)
+}
+
 func (r *emailSender) Validate(address string) bool {
 	match, _ := regexp.MatchString(r.validationRE, address)
 	return match
@@ -1,39 +1,49 @@
 package main
 
 import (
-	"encoding/json"
 	"net/http"
 	"strings"
 )
 
-func (ns *notificationServer) getSubscribersHandler(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
+// internalKeys and internalKeyPrefixes list the redis keys the service uses
+// for its own bookkeeping. All other keys are subscriptions.
+var (
+	internalKeys        = []string{"counters", templatesKey, ackMessagesKey}
+	internalKeyPrefixes = []string{"msg-", "queue-", "deliveries-", "counters-", "recipients-", "updates-", "ratelimit-", "digest-", "acks-"}
+)
 
-	u, p, ok := r.BasicAuth()
-	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
+func isSubscriptionKey(key string) bool {
+	for _, internalKey := range internalKeys {
+		if key == internalKey {
+			return false
+		}
+	}
+
+	for _, prefix := range internalKeyPrefixes {
+		if strings.HasPrefix(key, prefix) {
+			return false
+		}
 	}
 
-	if expectedPw, ok := ns.apiUsers[u]; !ok || expectedPw != p {
-		w.WriteHeader(http.StatusUnauthorized)
+	return true
+}
+
+func (ns *notificationServer) getSubscribersHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
 		return
 	}
 
 	numAllKeys, _ := ns.redisClient.DBSize(r.Context()).Result()
 	allKeys, _, _ := ns.redisClient.Scan(r.Context(), 0, "*", numAllKeys).Result()
 
-	var subscribers []string
+	subscribers := []string{}
 	for _, key := range allKeys {
-		if (!strings.HasPrefix(key, "msg-")) && (key != "counters") {
+		if isSubscriptionKey(key) {
 			subscribers = append(subscribers, key)
 		}
 	}
 
-	jsonSubs, err := json.Marshal(subscribers)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-	}
-
-	w.Write(jsonSubs)
+	writeData(w, http.StatusOK, subscribers)
 }
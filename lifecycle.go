@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const (
+	defaultResolvedSubjectPrefix = "Resolved: "
+	defaultResolvedMessage       = "This issue has been resolved."
+)
+
+// followUpBody is the body of an update or resolve of a message. Fields that
+// are left out are taken from the original message where that makes sense.
+type followUpBody struct {
+	Subject   string                 `json:"subject"`
+	Message   string                 `json:"message"`
+	Severity  string                 `json:"severity,omitempty"`
+	Format    string                 `json:"format,omitempty"`
+	Template  string                 `json:"template,omitempty"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+	Actions   []messageAction        `json:"actions,omitempty"`
+}
+
+type followUpResult struct {
+	Key        string `json:"key"`
+	FollowUp   string `json:"followUp"`
+	State      string `json:"state"`
+	Recipients int    `json:"recipients"`
+	Queued     int    `json:"queued"`
+}
+
+// followUpKey returns the key the delivery status of a follow-up is recorded under.
+func followUpKey(key, followUp string) string {
+	return key + "/" + followUp
+}
+
+func (ns *notificationServer) updateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ns.followUpHandler(w, r, false)
+}
+
+func (ns *notificationServer) resolveMessageHandler(w http.ResponseWriter, r *http.Request) {
+	ns.followUpHandler(w, r, true)
+}
+
+func (ns *notificationServer) followUpHandler(w http.ResponseWriter, r *http.Request, resolve bool) {
+	defer r.Body.Close()
+
+	apiUser, ok := ns.requireApiUser(w, r)
+	if !ok {
+		return
+	}
+
+	ctx := r.Context()
+	key := mux.Vars(r)["id"]
+
+	var body followUpBody
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !(resolve && err == io.EOF) {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "Unable to decode follow-up: %v", err))
+		return
+	}
+
+	record, err := ns.getMessage(ctx, key)
+	if err == redis.Nil {
+		writeError(w, newApiError(http.StatusNotFound, errMessageNotFound, "message %s not found", key))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	if apiErr := checkFollowUp(record); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	msg := followUpMessage(record.Message, body, resolve)
+	if !resolve && msg.Template == "" && msg.Message == "" {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidMessage, "message or template is required"))
+		return
+	}
+
+	msg, apiErr := ns.prepareMessage(ctx, msg)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	//follow-ups keep the quiet hours override of the original, the api user sending them must be allowed to use it
+	if apiErr := ns.authorizeMessage(apiUser, msg); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	result, err := ns.sendFollowUp(ctx, record, msg, resolve)
+	if err != nil {
+		apiErr := toApiError(err)
+		if apiErr.Status == http.StatusInternalServerError {
+			log.Println(err)
+		}
+		writeError(w, apiErr)
+		return
+	}
+
+	writeData(w, http.StatusAccepted, result)
+}
+
+// checkFollowUp fails when the message can't be followed up in its state.
+func checkFollowUp(record messageRecord) *apiError {
+	switch record.State {
+	case messageScheduled, messageDispatching, messageResolving, messageCancelled:
+		return newApiError(http.StatusConflict, errMessageNotSent, "message %s hasn't been sent yet", record.Key)
+	case messageFailed:
+		return newApiError(http.StatusConflict, errMessageNotSent, "message %s couldn't be sent", record.Key)
+	case messageResolved:
+		return newApiError(http.StatusConflict, errMessageResolved, "message %s is already resolved", record.Key)
+	}
+
+	return nil
+}
+
+// followUpMessage builds the message for a follow-up from the original.
+func followUpMessage(original messageBody, body followUpBody, resolve bool) messageBody {
+	msg := original
+	msg.Subject = body.Subject
+	msg.Message = body.Message
+	msg.Template = body.Template
+	msg.Variables = body.Variables
+	msg.SendAt = nil
+
+	if body.Severity != "" {
+		msg.Severity = body.Severity
+	}
+	if body.Format != "" {
+		msg.Format = body.Format
+	}
+	if len(body.Actions) > 0 {
+		msg.Actions = body.Actions
+	}
+
+	if msg.Template == "" && msg.Subject == "" {
+		msg.Subject = original.Subject
+		if resolve {
+			msg.Subject = defaultResolvedSubjectPrefix + original.Subject
+		}
+	}
+
+	if resolve {
+		if body.Severity == "" {
+			msg.Severity = severityInfo
+		}
+		if msg.Template == "" && msg.Message == "" {
+			msg.Message = defaultResolvedMessage
+		}
+	}
+
+	return msg
+}
+
+// sendFollowUp sends the follow-up to the recipients of the original message,
+// also when the membership of the targets changed since. The state of the
+// message is checked and changed atomically first, so of concurrent resolves
+// only one is sent and no update is sent after a resolve.
+func (ns *notificationServer) sendFollowUp(ctx context.Context, record messageRecord, msg messageBody, resolve bool) (followUpResult, error) {
+	now := time.Now()
+	key := record.Key
+
+	updates := 0
+	if !resolve {
+		var err error
+		updates, err = ns.nextUpdate(ctx, key)
+		if err != nil {
+			return followUpResult{}, err
+		}
+	}
+
+	record, err := ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+		if apiErr := checkFollowUp(*stored); apiErr != nil {
+			return apiErr
+		}
+
+		if resolve {
+			stored.State = messageResolved
+			stored.ResolvedAt = &now
+		} else if updates > stored.Updates {
+			stored.Updates = updates
+		}
+		return nil
+	})
+	if err == redis.Nil {
+		return followUpResult{}, newApiError(http.StatusNotFound, errMessageNotFound, "message %s not found", key)
+	}
+	if err != nil {
+		return followUpResult{}, err
+	}
+	if !resolve {
+		record.Updates = updates
+	}
+
+	followUp := fmt.Sprintf("update-%d", record.Updates)
+	if resolve {
+		followUp = messageResolved
+	}
+
+	result := followUpResult{
+		Key:      record.Key,
+		FollowUp: followUp,
+		State:    record.State,
+	}
+
+	users, err := ns.getRecipients(ctx, record.Key)
+	if err != nil {
+		return result, err
+	}
+	result.Recipients = len(users)
+
+	n := msg.Notification()
+	n.Thread = record.Key
+	n.FollowUp = followUp
+	n.RequireAck = false
+
+	result.Queued, err = ns.queueDeliveries(ctx, followUpKey(record.Key, followUp), usersByName(users), n)
+	if err != nil {
+		return result, err
+	}
+
+	//a resolved message isn't escalated anymore
+	if resolve && record.Message.RequireAck {
+		if err := ns.escalationQueue.Remove(ctx, record.Key); err != nil {
+			log.Println(err)
+		}
+	}
+
+	return result, nil
+}
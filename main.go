@@ -26,7 +26,7 @@ func main() {
 		log.Fatalf("Error loading config: %v", err.Error())
 	}
 
-	cfSpaceUserGetter := NewCfSpaceUserGetter()
+	cfEnvs := NewCfEnvironments(config.CFNameCacheTTL)
 
 	log.Println("Loading environments...")
 	for environment, cfapi := range config.CFApi {
@@ -49,7 +49,7 @@ func main() {
 			log.Fatalln("Failed logging into cloudfoundry", err)
 		}
 
-		cfSpaceUserGetter.RegisterEnvironment(environment, cfClient)
+		cfEnvs.RegisterEnvironment(environment, cfClient)
 	}
 
 	provider, err := oidc.NewProvider(context.Background(), config.OauthProviderUrl)
@@ -84,9 +84,48 @@ func main() {
 		welcomeMessage: config.WelcomeMessage,
 		goodbyeSubject: config.GoodbyeSubject,
 		goodbyeMessage: config.GoodbyeMessage,
+
+		deliveryQueue:        NewRedisQueue(redisCl, "deliveries"),
+		deliveryMaxAttempts:  config.DeliveryMaxAttempts,
+		deliveryTimeout:      config.DeliveryTimeout,
+		deliveryRetryDelay:   config.DeliveryRetryDelay,
+		deliveryPollInterval: config.DeliveryPollInterval,
+		scheduleQueue:        NewRedisQueue(redisCl, "scheduled"),
+
+		deliveryReportRetention: config.DeliveryReportRetention,
+		defaultValidity:         config.DefaultValidity,
+		batchMaxMessages:        config.BatchMaxMessages,
+
+		rateLimitApiUser:  config.ApiUserRateLimit,
+		rateLimitApiUsers: config.ApiUsersRateLimit,
+		rateLimitTarget:   config.TargetRateLimit,
+
+		digestQueue:   NewRedisQueue(redisCl, "digests"),
+		digestDailyAt: config.DigestDailyAtOffset,
+
+		quietHoursOverrideUsers: config.QuietHoursOverrideUsers,
+
+		ackSecret:        []byte(config.AckSecret),
+		ackBaseURL:       config.AckBaseURL,
+		ackAddressTypes:  config.AckAddressTypes,
+		ackEscalateAfter: config.AckEscalateAfter,
+		escalationQueue:  NewRedisQueue(redisCl, "escalations"),
+
+		actionURLSchemes: config.ActionURLSchemes,
+	}
+
+	if ns.ackBaseURL == "" {
+		ns.ackBaseURL = "https://" + appEnv.ApplicationURIs[0]
 	}
 
-	ns.RegisterUserGetter("space", cfSpaceUserGetter)
+	ns.RegisterUserGetter("space", NewCfSpaceUserGetter(cfEnvs))
+	ns.RegisterUserGetter("org", NewCfOrgUserGetter(cfEnvs))
+	ns.RegisterUserGetter("app", NewCfAppUserGetter(cfEnvs))
+	ns.RegisterUserGetter("service", NewCfServiceUserGetter(cfEnvs))
+	ns.RegisterUserGetter("stack", NewCfStackUserGetter(cfEnvs))
+	ns.RegisterUserGetter("buildpack", NewCfBuildpackUserGetter(cfEnvs))
+	ns.RegisterUserGetter("labels", NewCfLabelUserGetter(cfEnvs))
+	ns.RegisterUserGetter("platform", NewCfPlatformUserGetter(cfEnvs))
 
 	if config.IpaHost != "" {
 		ipaClient, err := freeipa.Connect(config.IpaHost, &http.Transport{
@@ -106,17 +145,58 @@ func main() {
 
 	if config.RabbitURI != "" {
 		for rabbitSender, template := range config.RabbitTemplates {
+			format, ok := config.RabbitFormats[rabbitSender]
+			if !ok {
+				format = formatText
+			}
+
 			log.Printf("Creating rabbitSender %s. Using exchange: %s\n", rabbitSender, config.RabbitExchange)
-			ns.RegisterNotificationSender(rabbitSender, NewRabbitSender(config.RabbitURI, config.RabbitExchange, template))
+			ns.RegisterNotificationSender(rabbitSender, NewRabbitSender(config.RabbitURI, config.RabbitExchange, template, format))
+		}
+
+		if config.RabbitAckQueue != "" {
+			log.Printf("Consuming acks from rabbit queue %s\n", config.RabbitAckQueue)
+			if err := ns.ConsumeRabbitAcks(config.RabbitURI, config.RabbitAckQueue); err != nil {
+				log.Fatalf("Error consuming rabbit acks: %v", err.Error())
+			}
 		}
 	}
 
-	collector := NewStatsCollector(redisCl)
+	if len(config.TemplateFiles) > 0 {
+		log.Println("Loading message templates...")
+		if err := ns.LoadTemplateFiles(context.Background(), config.TemplateFiles); err != nil {
+			log.Fatalf("Error loading message templates: %v", err.Error())
+		}
+	}
+
+	ns.StartDeliveryWorkers(context.Background(), config.DeliveryWorkers)
+	ns.StartScheduler(context.Background(), config.SchedulerPollInterval)
+	ns.StartDigests(context.Background(), config.DigestPollInterval)
+	ns.StartEscalations(context.Background(), config.AckPollInterval)
+
+	collector := NewStatsCollector(redisCl, ns.deliveryQueue)
 	prometheus.MustRegister(collector)
 
 	r := mux.NewRouter()
 	r.Path("/").Methods(http.MethodGet).HandlerFunc(ns.rootHandler)
 	r.Path("/send").Methods(http.MethodPost).HandlerFunc(ns.sendHandler)
+	r.Path("/send/batch").Methods(http.MethodPost).HandlerFunc(ns.sendBatchHandler)
+	r.Path("/messages/{id:.+}/deliveries").Methods(http.MethodGet).HandlerFunc(ns.deliveriesHandler)
+	r.Path("/messages/{id:.+}/update").Methods(http.MethodPost).HandlerFunc(ns.updateMessageHandler)
+	r.Path("/messages/{id:.+}/resolve").Methods(http.MethodPost).HandlerFunc(ns.resolveMessageHandler)
+	r.Path("/messages/{id:.+}/acks").Methods(http.MethodGet).HandlerFunc(ns.messageAcksHandler)
+	r.Path("/acks").Methods(http.MethodGet).HandlerFunc(ns.listAcksHandler)
+	r.Path("/ack/{token}").Methods(http.MethodGet).HandlerFunc(ns.ackPageHandler)
+	r.Path("/ack/{token}").Methods(http.MethodPost).HandlerFunc(ns.ackHandler)
+
+	r.Path("/scheduled").Methods(http.MethodGet).HandlerFunc(ns.listScheduledHandler)
+	r.Path("/scheduled/{key:.+}").Methods(http.MethodPut).HandlerFunc(ns.rescheduleHandler)
+	r.Path("/scheduled/{key:.+}").Methods(http.MethodDelete).HandlerFunc(ns.cancelScheduledHandler)
+
+	r.Path("/templates").Methods(http.MethodGet).HandlerFunc(ns.listTemplatesHandler)
+	r.Path("/templates/{name}").Methods(http.MethodGet).HandlerFunc(ns.getTemplateHandler)
+	r.Path("/templates/{name}").Methods(http.MethodPut).HandlerFunc(ns.putTemplateHandler)
+	r.Path("/templates/{name}").Methods(http.MethodDelete).HandlerFunc(ns.deleteTemplateHandler)
 
 	r.Path("/subscribe/{username}").Methods(http.MethodPost).HandlerFunc(ns.subscribeHandler)
 
@@ -128,6 +208,7 @@ func main() {
 
 	r.Path("/stats").HandlerFunc(collector.statsHandler)
 	r.Path("/metrics").Handler(promhttp.Handler())
+	r.Path("/openapi.json").Methods(http.MethodGet).HandlerFunc(openApiHandler)
 
 	r.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static"))))
 
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// This is a small markdown renderer for the subset of markdown that is useful
+// in notifications: headings, paragraphs, lists, quotes, code blocks, links,
+// bold, italic and inline code.
+
+const (
+	mdParagraph = iota
+	mdHeading
+	mdList
+	mdOrderedList
+	mdQuote
+	mdCode
+)
+
+type mdBlock struct {
+	kind  int
+	level int
+	lines []string
+}
+
+var (
+	mdHeadingRE     = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*$`)
+	mdListRE        = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	mdOrderedListRE = regexp.MustCompile(`^\s*\d+[.)]\s+(.*)$`)
+	mdQuoteRE       = regexp.MustCompile(`^>\s?(.*)$`)
+
+	mdLinkRE = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdURLRE  = regexp.MustCompile(`(?:https?://|mailto:)[^\s<>]*[^\s<>*_.,;:!?)]`)
+
+	//emphasis markers must touch the text they emphasize, so 2 * 3 * 4 stays as it is
+	mdBoldRE           = regexp.MustCompile(`\*\*([^\s*](?:.*?[^\s*])?)\*\*`)
+	mdUnderscoreBoldRE = regexp.MustCompile(`(^|\W)__([^\s_](?:.*?[^\s_])?)__(\W|$)`)
+	mdItalicRE         = regexp.MustCompile(`\*([^\s*](?:[^*]*[^\s*])?)\*`)
+
+	mdPlaceholderRE = regexp.MustCompile("\x00[0-9]+\x00")
+)
+
+// mdTargets holds the link targets and urls of a piece of text while its
+// emphasis is rendered, so the emphasis markup can't change them.
+type mdTargets []string
+
+// protect returns a placeholder for the url.
+func (t *mdTargets) protect(url string) string {
+	*t = append(*t, url)
+	return "\x00" + strconv.Itoa(len(*t)-1) + "\x00"
+}
+
+// restore puts the urls back in place of their placeholders.
+func (t mdTargets) restore(text string) string {
+	return mdPlaceholderRE.ReplaceAllStringFunc(text, func(placeholder string) string {
+		i, _ := strconv.Atoi(strings.Trim(placeholder, "\x00"))
+		if i >= len(t) {
+			return placeholder
+		}
+		return t[i]
+	})
+}
+
+func parseMarkdown(src string) []mdBlock {
+	var (
+		blocks  []mdBlock
+		current *mdBlock
+	)
+
+	closeBlock := func() {
+		if current != nil {
+			blocks = append(blocks, *current)
+			current = nil
+		}
+	}
+
+	lines := strings.Split(strings.ReplaceAll(src, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimRight(lines[i], " \t")
+
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			closeBlock()
+			code := mdBlock{kind: mdCode}
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), "```"); i++ {
+				code.lines = append(code.lines, lines[i])
+			}
+			blocks = append(blocks, code)
+			continue
+		}
+
+		if strings.TrimSpace(line) == "" {
+			closeBlock()
+			continue
+		}
+
+		if m := mdHeadingRE.FindStringSubmatch(line); m != nil {
+			closeBlock()
+			blocks = append(blocks, mdBlock{kind: mdHeading, level: len(m[1]), lines: []string{m[2]}})
+			continue
+		}
+
+		if m := mdListRE.FindStringSubmatch(line); m != nil {
+			if current == nil || current.kind != mdList {
+				closeBlock()
+				current = &mdBlock{kind: mdList}
+			}
+			current.lines = append(current.lines, m[1])
+			continue
+		}
+
+		if m := mdOrderedListRE.FindStringSubmatch(line); m != nil {
+			if current == nil || current.kind != mdOrderedList {
+				closeBlock()
+				current = &mdBlock{kind: mdOrderedList}
+			}
+			current.lines = append(current.lines, m[1])
+			continue
+		}
+
+		if m := mdQuoteRE.FindStringSubmatch(line); m != nil {
+			if current == nil || current.kind != mdQuote {
+				closeBlock()
+				current = &mdBlock{kind: mdQuote}
+			}
+			current.lines = append(current.lines, m[1])
+			continue
+		}
+
+		if current == nil {
+			current = &mdBlock{kind: mdParagraph}
+		}
+
+		//lines that don't start a new block continue the current one, for lists that's the last item
+		if (current.kind == mdList || current.kind == mdOrderedList) && len(current.lines) > 0 {
+			current.lines[len(current.lines)-1] += " " + strings.TrimSpace(line)
+		} else {
+			current.lines = append(current.lines, strings.TrimSpace(line))
+		}
+	}
+	closeBlock()
+
+	return blocks
+}
+
+// markdownToHTML renders markdown as an html fragment.
+func markdownToHTML(src string) string {
+	var out strings.Builder
+
+	for _, block := range parseMarkdown(src) {
+		switch block.kind {
+		case mdHeading:
+			fmt.Fprintf(&out, "<h%d>%s</h%d>\n", block.level, inlineToHTML(block.lines[0]), block.level)
+		case mdList, mdOrderedList:
+			tag := "ul"
+			if block.kind == mdOrderedList {
+				tag = "ol"
+			}
+			fmt.Fprintf(&out, "<%s>\n", tag)
+			for _, item := range block.lines {
+				fmt.Fprintf(&out, "<li>%s</li>\n", inlineToHTML(item))
+			}
+			fmt.Fprintf(&out, "</%s>\n", tag)
+		case mdQuote:
+			fmt.Fprintf(&out, "<blockquote>%s</blockquote>\n", inlineToHTML(strings.Join(block.lines, " ")))
+		case mdCode:
+			fmt.Fprintf(&out, "<pre><code>%s</code></pre>\n", html.EscapeString(strings.Join(block.lines, "\n")))
+		default:
+			fmt.Fprintf(&out, "<p>%s</p>\n", inlineToHTML(strings.Join(block.lines, "\n")))
+		}
+	}
+
+	return out.String()
+}
+
+// markdownToText strips the markdown syntax for channels that can only show
+// plain text.
+func markdownToText(src string) string {
+	var paragraphs []string
+
+	for _, block := range parseMarkdown(src) {
+		var text string
+
+		switch block.kind {
+		case mdList:
+			var items []string
+			for _, item := range block.lines {
+				items = append(items, "- "+inlineToText(item))
+			}
+			text = strings.Join(items, "\n")
+		case mdOrderedList:
+			var items []string
+			for i, item := range block.lines {
+				items = append(items, fmt.Sprintf("%d. %s", i+1, inlineToText(item)))
+			}
+			text = strings.Join(items, "\n")
+		case mdCode:
+			text = strings.Join(block.lines, "\n")
+		case mdQuote:
+			text = "\"" + inlineToText(strings.Join(block.lines, " ")) + "\""
+		default:
+			text = inlineToText(strings.Join(block.lines, "\n"))
+		}
+
+		paragraphs = append(paragraphs, text)
+	}
+
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// inlineToHTML renders the inline markup of a piece of text. Text between
+// backticks is code and is left alone.
+func inlineToHTML(text string) string {
+	parts := strings.Split(text, "`")
+	for i, part := range parts {
+		part = html.EscapeString(part)
+		if i%2 == 1 && i < len(parts)-1 {
+			parts[i] = "<code>" + part + "</code>"
+			continue
+		}
+
+		if i%2 == 1 { //unmatched backtick
+			part = "`" + part
+		}
+
+		var targets mdTargets
+		part = mdLinkRE.ReplaceAllStringFunc(part, func(link string) string {
+			m := mdLinkRE.FindStringSubmatch(link)
+			if !isSafeLink(html.UnescapeString(m[2])) {
+				return m[1]
+			}
+			return fmt.Sprintf(`<a href="%s">%s</a>`, targets.protect(m[2]), m[1])
+		})
+		part = mdURLRE.ReplaceAllStringFunc(part, targets.protect)
+		part = mdBoldRE.ReplaceAllString(part, "<strong>$1</strong>")
+		part = mdUnderscoreBoldRE.ReplaceAllString(part, "$1<strong>$2</strong>$3")
+		part = mdItalicRE.ReplaceAllString(part, "<em>$1</em>")
+		parts[i] = strings.ReplaceAll(targets.restore(part), "\n", "<br>\n")
+	}
+
+	return strings.Join(parts, "")
+}
+
+func inlineToText(text string) string {
+	parts := strings.Split(text, "`")
+	for i, part := range parts {
+		if i%2 == 1 && i < len(parts)-1 {
+			continue
+		}
+
+		if i%2 == 1 { //unmatched backtick
+			part = "`" + part
+		}
+
+		var targets mdTargets
+		part = mdLinkRE.ReplaceAllStringFunc(part, func(link string) string {
+			m := mdLinkRE.FindStringSubmatch(link)
+			return m[1] + " (" + targets.protect(m[2]) + ")"
+		})
+		part = mdURLRE.ReplaceAllStringFunc(part, targets.protect)
+		part = mdBoldRE.ReplaceAllString(part, "$1")
+		part = mdUnderscoreBoldRE.ReplaceAllString(part, "$1$2$3")
+		part = mdItalicRE.ReplaceAllString(part, "$1")
+		parts[i] = targets.restore(part)
+	}
+
+	return strings.Join(parts, "")
+}
+
+func isSafeLink(url string) bool {
+	for _, scheme := range []string{"https://", "http://", "mailto:"} {
+		if strings.HasPrefix(strings.ToLower(url), scheme) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestInlineToHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "disk full", "disk full"},
+		{"bold", "disk **full**", "disk <strong>full</strong>"},
+		{"underscore bold", "disk __full__", "disk <strong>full</strong>"},
+		{"italic", "disk *full*", "disk <em>full</em>"},
+		{"bold and italic", "**disk** *full*", "<strong>disk</strong> <em>full</em>"},
+		{"spaced asterisks", "2 * 3 * 4", "2 * 3 * 4"},
+		{"spaced bold markers", "** not bold **", "** not bold **"},
+		{"underscores within a word", "disk__full__x", "disk__full__x"},
+		{"link", "[runbook](https://wiki.example.com/runbooks)", `<a href="https://wiki.example.com/runbooks">runbook</a>`},
+		{"link with underscores", "[runbook](https://wiki.example.com/runbooks/disk__full__x)", `<a href="https://wiki.example.com/runbooks/disk__full__x">runbook</a>`},
+		{"link with asterisks", "[search](https://example.com/a*b*c)", `<a href="https://example.com/a*b*c">search</a>`},
+		{"emphasis in a link label", "[**runbook**](https://example.com)", `<a href="https://example.com"><strong>runbook</strong></a>`},
+		{"link in emphasis", "*see [runbook](https://example.com/a_b_)*", `<em>see <a href="https://example.com/a_b_">runbook</a></em>`},
+		{"unsafe link target", "[click](javascript:alert)", "click"},
+		{"bare url", "see https://example.com/a*b*c", "see https://example.com/a*b*c"},
+		{"bare url in bold", "**https://example.com/x**", "<strong>https://example.com/x</strong>"},
+		{"code span", "run `rm *.log *now*`", "run <code>rm *.log *now*</code>"},
+		{"code span escaped", "`<b>`", "<code>&lt;b&gt;</code>"},
+		{"unmatched backtick", "a ` *b*", "a ` <em>b</em>"},
+		{"escaped html", "<b>x</b>", "&lt;b&gt;x&lt;/b&gt;"},
+		{"line break", "a\nb", "a<br>\nb"},
+		{"placeholder lookalike", "a \x007\x00 b", "a \x007\x00 b"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inlineToHTML(tt.in); got != tt.want {
+				t.Errorf("inlineToHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInlineToText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"bold", "disk **full**", "disk full"},
+		{"underscore bold", "disk __full__", "disk full"},
+		{"italic", "disk *full*", "disk full"},
+		{"spaced asterisks", "2 * 3 * 4", "2 * 3 * 4"},
+		{"link", "[runbook](https://wiki.example.com/runbooks/disk__full__x)", "runbook (https://wiki.example.com/runbooks/disk__full__x)"},
+		{"bare url", "see https://example.com/a*b*c", "see https://example.com/a*b*c"},
+		{"bare url in bold", "**https://example.com/x**", "https://example.com/x"},
+		{"code span", "run `rm *.log`", "run rm *.log"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inlineToText(tt.in); got != tt.want {
+				t.Errorf("inlineToText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkdownToHTML(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"heading", "# Disk *full*", "<h1>Disk <em>full</em></h1>\n"},
+		{"list", "- [runbook](https://example.com/a__b__c)\n- 2 * 3", "<ul>\n<li><a href=\"https://example.com/a__b__c\">runbook</a></li>\n<li>2 * 3</li>\n</ul>\n"},
+		{"code block", "```\n**not bold**\n```", "<pre><code>**not bold**</code></pre>\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := markdownToHTML(tt.in); got != tt.want {
+				t.Errorf("markdownToHTML(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -1,21 +1,343 @@
 package main
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	formatText     = "text"
+	formatMarkdown = "markdown"
+)
+
+const (
+	severityInfo     = "info"
+	severityWarning  = "warning"
+	severityCritical = "critical"
+)
 
 type messageTarget struct {
 	Type        string `json:"type"`
 	Environment string `json:"environment,omitempty"`
 	Id          string `json:"id"`
+
+	//org targets only: also notify the members of the spaces in the org
+	IncludeSpaces bool `json:"includeSpaces,omitempty"`
+	//space and org targets: only notify users with one of these roles
+	Roles []string `json:"roles,omitempty"`
+	//service targets only: only the instances of this plan
+	Plan string `json:"plan,omitempty"`
+	//label targets only: select spaces (default) or orgs
+	Resource string `json:"resource,omitempty"`
+}
+
+func (t messageTarget) String() string {
+	return fmt.Sprintf("%s:%s:%s", t.Type, t.Environment, t.Id)
+}
+
+// messageAction is a link shown with the message, as a button where the
+// channel supports it.
+type messageAction struct {
+	Label string `json:"label"`
+	URL   string `json:"url"`
 }
 
 type messageBody struct {
-	Id        string        `json:"id"`
-	Subject   string        `json:"subject"`
-	Message   string        `json:"message"`
-	ExpiresIn string        `json:"validity,omitempty"`
-	Target    messageTarget `json:"target"`
+	Id        string                 `json:"id"`
+	Subject   string                 `json:"subject"`
+	Message   string                 `json:"message"`
+	ExpiresIn string                 `json:"validity,omitempty"`
+	Target    messageTarget          `json:"target"`
+	Targets   []messageTarget        `json:"targets,omitempty"`
+	DedupeBy  string                 `json:"dedupeBy,omitempty"`
+	DedupeKey string                 `json:"dedupeKey,omitempty"`
+	SendAt    *time.Time             `json:"sendAt,omitempty"`
+	Severity  string                 `json:"severity,omitempty"`
+	Format    string                 `json:"format,omitempty"`
+	Template  string                 `json:"template,omitempty"`
+	Variables map[string]interface{} `json:"variables,omitempty"`
+	Actions   []messageAction        `json:"actions,omitempty"`
+
+	OverrideQuietHours bool `json:"overrideQuietHours,omitempty"`
+
+	RequireAck    bool   `json:"requireAck,omitempty"`
+	EscalateAfter string `json:"escalateAfter,omitempty"`
 }
 
 func (m messageBody) MarshalBinary() ([]byte, error) {
 	return json.Marshal(m)
 }
+
+// Validate checks the fields that don't depend on the configured targets and senders.
+func (m messageBody) Validate() error {
+	if m.Id == "" {
+		return fmt.Errorf("id is required")
+	}
+
+	if m.Template != "" && (m.Subject != "" || m.Message != "") {
+		return fmt.Errorf("use either a template or a subject and message")
+	}
+
+	if len(m.Targets) == 0 && m.Target.Type == "" {
+		return fmt.Errorf("target or targets is required")
+	}
+
+	for _, t := range m.AllTargets() {
+		if t.Type == "" {
+			return fmt.Errorf("target type is required")
+		}
+		for _, role := range t.Roles {
+			if !isCfRole(role) {
+				return fmt.Errorf("unknown role %q", role)
+			}
+		}
+		switch t.Resource {
+		case "", "space", "org":
+		default:
+			return fmt.Errorf("invalid resource %q, use space or org", t.Resource)
+		}
+	}
+
+	if m.ExpiresIn != "" {
+		if _, err := time.ParseDuration(m.ExpiresIn); err != nil {
+			return fmt.Errorf("invalid validity: %v", err)
+		}
+	}
+
+	switch m.Severity {
+	case "", severityInfo, severityWarning, severityCritical:
+	default:
+		return fmt.Errorf("invalid severity %q, use info, warning or critical", m.Severity)
+	}
+
+	switch m.Format {
+	case "", formatText, formatMarkdown:
+	default:
+		return fmt.Errorf("invalid format %q, use text or markdown", m.Format)
+	}
+
+	for _, a := range m.Actions {
+		if a.Label == "" || a.URL == "" {
+			return fmt.Errorf("actions need a label and url")
+		}
+		if u, err := url.Parse(a.URL); err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "") {
+			return fmt.Errorf("invalid url %q for action %s", a.URL, a.Label)
+		}
+	}
+
+	if m.EscalateAfter != "" {
+		if !m.RequireAck {
+			return fmt.Errorf("escalateAfter requires requireAck")
+		}
+		if d, err := time.ParseDuration(m.EscalateAfter); err != nil || d <= 0 {
+			return fmt.Errorf("invalid escalateAfter %q", m.EscalateAfter)
+		}
+	}
+
+	switch m.DedupeBy {
+	case "", "id", "id+target":
+	default:
+		return fmt.Errorf("invalid dedupeBy %q, use id or id+target", m.DedupeBy)
+	}
+
+	return nil
+}
+
+// Key returns the key the message is deduplicated and stored by. Unless the
+// caller gives an explicit dedupeKey this is the message id, optionally
+// combined with the target so one id can be sent to several targets.
+func (m messageBody) Key() string {
+	if m.DedupeKey != "" {
+		return m.DedupeKey
+	}
+
+	if m.DedupeBy == "id+target" {
+		var targets []string
+		for _, t := range m.AllTargets() {
+			targets = append(targets, t.String())
+		}
+		sort.Strings(targets)
+
+		return m.Id + ":" + strings.Join(targets, ",")
+	}
+
+	return m.Id
+}
+
+// AllTargets returns the targets of the message. The single target field is
+// still accepted for callers that address one target.
+func (m messageBody) AllTargets() []messageTarget {
+	if len(m.Targets) > 0 {
+		return m.Targets
+	}
+
+	return []messageTarget{m.Target}
+}
+
+// Validity returns how long the message is kept to block duplicates. For
+// scheduled messages this starts when the message is due.
+func (m messageBody) Validity(defaultValidity time.Duration) time.Duration {
+	exp, err := time.ParseDuration(m.ExpiresIn)
+	if err != nil || exp <= 0 {
+		exp = defaultValidity
+	}
+
+	if m.IsScheduled() {
+		exp += time.Until(*m.SendAt)
+	}
+
+	return exp
+}
+
+// EscalationDelay returns how long recipients get to acknowledge the message.
+func (m messageBody) EscalationDelay(def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(m.EscalateAfter); err == nil {
+		return d
+	}
+
+	return def
+}
+
+// IsScheduled tells if the message should be sent at a later time.
+func (m messageBody) IsScheduled() bool {
+	return m.SendAt != nil && m.SendAt.After(time.Now())
+}
+
+// Notification returns what is sent to every recipient of the message.
+func (m messageBody) Notification() notification {
+	severity := m.Severity
+	if severity == "" {
+		severity = severityInfo
+	}
+
+	format := m.Format
+	if format == "" {
+		format = formatText
+	}
+
+	return notification{
+		Subject:  m.Subject,
+		Message:  m.Message,
+		Format:   format,
+		Severity: severity,
+		Actions:  m.Actions,
+
+		OverrideQuietHours: m.OverrideQuietHours,
+		RequireAck:         m.RequireAck,
+	}
+}
+
+// notification is what a NotificationSender sends to a single address.
+type notification struct {
+	Subject  string          `json:"subject"`
+	Message  string          `json:"message"`
+	Format   string          `json:"format"`
+	Severity string          `json:"severity"`
+	Thread   string          `json:"thread,omitempty"`
+	FollowUp string          `json:"followUp,omitempty"`
+	Actions  []messageAction `json:"actions,omitempty"`
+
+	OverrideQuietHours bool `json:"overrideQuietHours,omitempty"`
+
+	//the ack link or token is set per recipient
+	RequireAck bool   `json:"requireAck,omitempty"`
+	AckURL     string `json:"ackUrl,omitempty"`
+	AckToken   string `json:"ackToken,omitempty"`
+
+	//details of the target for the recipient, like the app the message is about
+	Target map[string]interface{} `json:"target,omitempty"`
+
+	//the template of the message, to render it with the target details
+	template  *messageTemplate
+	variables map[string]interface{}
+}
+
+// ForRecipient returns the notification with the target details of a
+// recipient. Messages from a template are rendered with them.
+func (n notification) ForRecipient(details map[string]interface{}) notification {
+	if len(details) == 0 {
+		return n
+	}
+
+	n.Target = details
+	if n.template == nil {
+		return n
+	}
+
+	subject, message, err := n.template.Render(templateData(n.variables, details))
+	if err != nil {
+		log.Printf("Unable to render template %s with target details: %v\n", n.template.Name, err)
+		return n
+	}
+	n.Subject = subject
+	n.Message = message
+
+	return n
+}
+
+// PlainText returns the message without markup.
+func (n notification) PlainText() string {
+	if n.Format == formatMarkdown {
+		return markdownToText(n.Message)
+	}
+
+	return n.Message
+}
+
+// HTML returns the message as an html fragment.
+func (n notification) HTML() string {
+	if n.Format == formatMarkdown {
+		return markdownToHTML(n.Message)
+	}
+
+	return "<p>" + strings.ReplaceAll(html.EscapeString(n.Message), "\n", "<br>\n") + "</p>\n"
+}
+
+// ActionsText returns the actions as a list of links.
+func (n notification) ActionsText() string {
+	if len(n.Actions) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString("\n\nLinks:")
+	for _, a := range n.Actions {
+		fmt.Fprintf(&out, "\n- %s: %s", a.Label, a.URL)
+	}
+
+	return out.String()
+}
+
+// ActionsHTML returns the actions as buttons. The styles are inline because
+// mail clients ignore style sheets.
+func (n notification) ActionsHTML() string {
+	if len(n.Actions) == 0 {
+		return ""
+	}
+
+	var out strings.Builder
+	out.WriteString("<p>\n")
+	for _, a := range n.Actions {
+		fmt.Fprintf(&out, `<a href="%s" style="display:inline-block;margin:4px 8px 4px 0;padding:8px 16px;background-color:#ff7376;color:#ffffff;text-decoration:none;border-radius:4px;font-family:Verdana,Geneva,Tahoma,sans-serif;font-size:12px;font-weight:bold">%s</a>`+"\n",
+			html.EscapeString(a.URL), html.EscapeString(a.Label))
+	}
+	out.WriteString("</p>\n")
+
+	return out.String()
+}
+
+// Render returns the message in the given format. Markdown messages are
+// returned as they are for channels that show markdown.
+func (n notification) Render(format string) string {
+	if format == formatMarkdown {
+		return n.Message
+	}
+
+	return n.PlainText()
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	messageScheduled   = "scheduled"
+	messageDispatching = "dispatching"
+	messageResolving   = "resolving"
+	messageDispatched  = "dispatched"
+	messageResolved    = "resolved"
+	messageFailed      = "failed"
+	messageCancelled   = "cancelled"
+)
+
+// the number of times a change of a message record is tried when other
+// changes of the same record get in between
+const messageChangeRetries = 10
+
+// messageRecord is stored for every accepted message. It blocks duplicates
+// for the validity of the message and tells a duplicate submission what
+// happened to the original.
+type messageRecord struct {
+	Key        string         `json:"key"`
+	Message    messageBody    `json:"message"`
+	AcceptedBy string         `json:"acceptedBy"`
+	AcceptedAt time.Time      `json:"acceptedAt"`
+	State      string         `json:"state"`
+	Targets    []targetResult `json:"targets,omitempty"`
+	Recipients int            `json:"recipients"`
+	Queued     int            `json:"queued"`
+	Updates    int            `json:"updates"`
+	ResolvedAt *time.Time     `json:"resolvedAt,omitempty"`
+	Attempts   int            `json:"attempts,omitempty"`
+	Error      string         `json:"error,omitempty"`
+
+	AckDeadline *time.Time `json:"ackDeadline,omitempty"`
+	EscalatedAt *time.Time `json:"escalatedAt,omitempty"`
+}
+
+type targetResult struct {
+	Target messageTarget `json:"target"`
+	Users  int           `json:"users"`
+	Error  string        `json:"error,omitempty"`
+}
+
+func (mr messageRecord) MarshalBinary() ([]byte, error) {
+	return json.Marshal(mr)
+}
+
+// sendResult is returned for an accepted message and for a duplicate of it.
+type sendResult struct {
+	Key        string         `json:"key"`
+	Id         string         `json:"id"`
+	Duplicate  bool           `json:"duplicate"`
+	AcceptedBy string         `json:"acceptedBy"`
+	AcceptedAt time.Time      `json:"acceptedAt"`
+	State      string         `json:"state"`
+	SendAt     *time.Time     `json:"sendAt,omitempty"`
+	Targets    []targetResult `json:"targets,omitempty"`
+	Recipients int            `json:"recipients"`
+	Queued     int            `json:"queued"`
+	Updates    int            `json:"updates"`
+	ResolvedAt *time.Time     `json:"resolvedAt,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Deliveries map[string]int `json:"deliveries"`
+
+	AckDeadline *time.Time `json:"ackDeadline,omitempty"`
+	EscalatedAt *time.Time `json:"escalatedAt,omitempty"`
+}
+
+func messageRecordKey(key string) string {
+	return "msg-" + key
+}
+
+func recipientsKey(key string) string {
+	return "recipients-" + key
+}
+
+func updatesKey(key string) string {
+	return "updates-" + key
+}
+
+// claimMessage atomically stores the record for a new message. When another
+// request, possibly on another instance, claimed the key first, the existing
+// record is returned and claimed is false.
+func (ns *notificationServer) claimMessage(ctx context.Context, apiUser string, msg messageBody) (messageRecord, bool, error) {
+	record := messageRecord{
+		Key:        msg.Key(),
+		Message:    msg,
+		AcceptedBy: apiUser,
+		AcceptedAt: time.Now(),
+		State:      messageDispatched,
+	}
+
+	if msg.IsScheduled() {
+		record.State = messageScheduled
+	} else if ns.isStreamed(msg) {
+		record.State = messageResolving
+	}
+
+	for {
+		claimed, err := ns.redisClient.SetNX(ctx, messageRecordKey(record.Key), record, msg.Validity(ns.defaultValidity)).Result()
+		if err != nil {
+			return record, false, err
+		}
+
+		if claimed {
+			return record, true, nil
+		}
+
+		existing, err := ns.getMessage(ctx, record.Key)
+		if err == redis.Nil { //expired in the meantime, try again
+			continue
+		}
+
+		return existing, false, err
+	}
+}
+
+func (ns *notificationServer) getMessage(ctx context.Context, key string) (messageRecord, error) {
+	var record messageRecord
+
+	recordString, err := ns.redisClient.Get(ctx, messageRecordKey(key)).Result()
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal([]byte(recordString), &record)
+	return record, err
+}
+
+// changeMessage applies change to the stored record and stores it without
+// changing how long it is kept. The record is watched, so a change never
+// undoes a concurrent one: it is applied again to the new record instead.
+// When change returns an error the record is left alone and the error is
+// returned. redis.Nil is returned when the record expired or was released.
+func (ns *notificationServer) changeMessage(ctx context.Context, key string, change func(record *messageRecord) error) (messageRecord, error) {
+	var record messageRecord
+
+	for i := 0; i < messageChangeRetries; i++ {
+		err := ns.redisClient.Watch(ctx, func(tx *redis.Tx) error {
+			recordString, err := tx.Get(ctx, messageRecordKey(key)).Result()
+			if err != nil {
+				return err
+			}
+
+			record = messageRecord{}
+			if err := json.Unmarshal([]byte(recordString), &record); err != nil {
+				return err
+			}
+
+			if err := change(&record); err != nil {
+				return err
+			}
+
+			_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.SetArgs(ctx, messageRecordKey(key), record, redis.SetArgs{KeepTTL: true})
+				return nil
+			})
+			return err
+		}, messageRecordKey(key))
+		if err != redis.TxFailedErr {
+			return record, err
+		}
+	}
+
+	return record, redis.TxFailedErr
+}
+
+// storeRecipients remembers the users a message was sent to for as long as
+// the message is kept.
+func (ns *notificationServer) storeRecipients(ctx context.Context, key string, users []string) error {
+	if len(users) == 0 {
+		return nil
+	}
+
+	ttl, err := ns.redisClient.PTTL(ctx, messageRecordKey(key)).Result()
+	if err != nil {
+		return err
+	}
+	if ttl == -2 { //the message expired or was released
+		return redis.Nil
+	}
+
+	members := make([]interface{}, len(users))
+	for i, u := range users {
+		members[i] = u
+	}
+
+	_, err = ns.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, recipientsKey(key), members...)
+		if ttl > 0 {
+			pipe.PExpire(ctx, recipientsKey(key), ttl)
+		}
+		return nil
+	})
+
+	return err
+}
+
+// nextUpdate returns the number of the next update of a message. The numbers
+// are counted in redis, so concurrent updates never get the same one.
+func (ns *notificationServer) nextUpdate(ctx context.Context, key string) (int, error) {
+	ttl, err := ns.redisClient.PTTL(ctx, messageRecordKey(key)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if ttl == -2 { //the message expired or was released
+		return 0, redis.Nil
+	}
+
+	var updates *redis.IntCmd
+	_, err = ns.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		updates = pipe.Incr(ctx, updatesKey(key))
+		if ttl > 0 {
+			pipe.PExpire(ctx, updatesKey(key), ttl)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return int(updates.Val()), nil
+}
+
+func (ns *notificationServer) getRecipients(ctx context.Context, key string) ([]string, error) {
+	return ns.redisClient.SMembers(ctx, recipientsKey(key)).Result()
+}
+
+// releaseMessage removes the claim on a message that couldn't be processed,
+// so the caller can submit it again.
+func (ns *notificationServer) releaseMessage(ctx context.Context, key string) error {
+	return ns.redisClient.Del(ctx, messageRecordKey(key), recipientsKey(key), updatesKey(key)).Err()
+}
+
+func (ns *notificationServer) getSendResult(ctx context.Context, record messageRecord, duplicate bool) sendResult {
+	result := sendResult{
+		Key:        record.Key,
+		Id:         record.Message.Id,
+		Duplicate:  duplicate,
+		AcceptedBy: record.AcceptedBy,
+		AcceptedAt: record.AcceptedAt,
+		State:      record.State,
+		SendAt:     record.Message.SendAt,
+		Targets:    record.Targets,
+		Recipients: record.Recipients,
+		Queued:     record.Queued,
+		Updates:    record.Updates,
+		ResolvedAt: record.ResolvedAt,
+		Error:      record.Error,
+		Deliveries: make(map[string]int),
+
+		AckDeadline: record.AckDeadline,
+		EscalatedAt: record.EscalatedAt,
+	}
+
+	report, err := ns.getDeliveryReport(ctx, record.Key)
+	if err != nil {
+		return result
+	}
+
+	for _, ds := range report.Deliveries {
+		result.Deliveries[ds.Status]++
+	}
+
+	return result
+}
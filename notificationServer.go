@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
@@ -9,7 +10,10 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/coreos/go-oidc/v3/oidc"
@@ -34,14 +38,174 @@ type notificationServer struct {
 	welcomeMessage      string
 	goodbyeSubject      string
 	goodbyeMessage      string
+
+	deliveryQueue        *redisQueue
+	deliveryMaxAttempts  int
+	deliveryTimeout      time.Duration
+	deliveryRetryDelay   time.Duration
+	deliveryPollInterval time.Duration
+	scheduleQueue        *redisQueue
+
+	deliveryReportRetention time.Duration
+	defaultValidity         time.Duration
+	batchMaxMessages        int
+
+	rateLimitApiUser  rateLimit
+	rateLimitApiUsers map[string]rateLimit
+	rateLimitTarget   rateLimit
+
+	digestQueue   *redisQueue
+	digestDailyAt time.Duration
+
+	quietHoursOverrideUsers []string
+
+	ackSecret        []byte
+	ackBaseURL       string
+	ackAddressTypes  []string
+	ackEscalateAfter time.Duration
+	escalationQueue  *redisQueue
+
+	actionURLSchemes []string
 }
 
 type UserGetter interface {
 	Get(string, string) ([]string, error)
 }
 
+// isAllowedActionURL checks the url of an action against the allowed schemes.
+func (ns *notificationServer) isAllowedActionURL(actionURL string) bool {
+	u, err := url.Parse(actionURL)
+	if err != nil {
+		return false
+	}
+
+	for _, scheme := range ns.actionURLSchemes {
+		if strings.EqualFold(u.Scheme, scheme) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// TargetUserGetter is implemented by user getters that support options on
+// the target beyond the environment and id.
+type TargetUserGetter interface {
+	GetTargetUsers(messageTarget) ([]targetUser, error)
+}
+
+// TargetDetailer is implemented by user getters that give every recipient
+// details about the target, like the app a message is about. TargetDetails
+// returns the details with empty values, to check message templates against.
+type TargetDetailer interface {
+	TargetDetails() map[string]interface{}
+}
+
+// targetUser is a recipient of a target with the roles it was matched by and
+// the details of the target for this recipient.
+type targetUser struct {
+	Username string
+	Roles    []string
+	Details  map[string]interface{}
+}
+
+func (tu *targetUser) addRoles(roles ...string) {
+	for _, role := range roles {
+		found := false
+		for _, r := range tu.Roles {
+			if r == role {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tu.Roles = append(tu.Roles, role)
+		}
+	}
+}
+
+// addDetails merges details of another target into those of the user. Lists
+// are combined, other values are kept from the first target.
+func (tu *targetUser) addDetails(details map[string]interface{}) {
+	if len(details) == 0 {
+		return
+	}
+
+	//the details of a target are shared by its users, so merge into a copy
+	merged := make(map[string]interface{}, len(tu.Details)+len(details))
+	for k, v := range tu.Details {
+		merged[k] = v
+	}
+
+	for k, v := range details {
+		current, ok := merged[k]
+		if !ok {
+			merged[k] = v
+			continue
+		}
+
+		currentList, isList := current.([]string)
+		addList, addIsList := v.([]string)
+		if isList && addIsList {
+			merged[k] = mergeStrings(currentList, addList)
+		}
+	}
+
+	tu.Details = merged
+}
+
+func mergeStrings(a, b []string) []string {
+	merged := append([]string{}, a...)
+	for _, s := range b {
+		found := false
+		for _, m := range merged {
+			if m == s {
+				found = true
+				break
+			}
+		}
+		if !found {
+			merged = append(merged, s)
+		}
+	}
+
+	return merged
+}
+
+func targetUsernames(users []targetUser) []string {
+	var names []string
+	for _, u := range users {
+		names = append(names, u.Username)
+	}
+
+	return names
+}
+
+// usersByName returns recipients that weren't matched by a role, like the
+// stored recipients of a message.
+func usersByName(names []string) []targetUser {
+	var users []targetUser
+	for _, name := range names {
+		users = append(users, targetUser{Username: name})
+	}
+
+	return users
+}
+
+// EnvironmentChecker is implemented by user getters that only know the
+// environments they are configured for.
+type EnvironmentChecker interface {
+	HasEnvironment(string) bool
+}
+
+// RoleChecker is implemented by user getters that only accept some of the
+// roles, for example the space roles for targets that select spaces.
+type RoleChecker interface {
+	CheckRoles(messageTarget) error
+}
+
 type NotificationSender interface {
-	Send(string, string, string) error
+	Send(string, notification) error
 	Validate(string) bool
 	GetValidationRE() string
 }
@@ -51,6 +215,10 @@ type NotificationSenders map[string]NotificationSender
 
 type Subscription struct {
 	Addresses map[string]string `json:"addresses"`
+	//delivery mode per address type: immediate, hourly or daily
+	Delivery          map[string]string `json:"delivery,omitempty"`
+	CriticalImmediate bool              `json:"criticalImmediate,omitempty"`
+	QuietHours        *quietHours       `json:"quietHours,omitempty"`
 }
 
 func (s Subscription) MarshalBinary() ([]byte, error) {
@@ -74,14 +242,8 @@ func (ns *notificationServer) RegisterNotificationSender(name string, sender Not
 func (ns *notificationServer) sendHandler(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
-	u, p, ok := r.BasicAuth()
+	apiUser, ok := ns.requireApiUser(w, r)
 	if !ok {
-		w.WriteHeader(http.StatusUnauthorized)
-		return
-	}
-
-	if expectedPw, ok := ns.apiUsers[u]; !ok || expectedPw != p {
-		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
@@ -91,100 +253,389 @@ func (ns *notificationServer) sendHandler(w http.ResponseWriter, r *http.Request
 
 	err := json.NewDecoder(r.Body).Decode(&msg)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "Unable to decode message: %v", err))
 		return
 	}
 
-	//fail if no ID was given
-	if msg.Id == "" {
-		w.WriteHeader(http.StatusBadRequest)
+	msg, apiErr := ns.prepareMessage(ctx, msg)
+	if apiErr != nil {
+		writeError(w, apiErr)
 		return
 	}
 
-	msgKey := "msg-" + msg.Id
+	if apiErr := ns.authorizeMessage(apiUser, msg); apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
 
-	exp, err := time.ParseDuration(msg.ExpiresIn)
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dryRun")); dryRun {
+		report, err := ns.dryRun(ctx, msg)
+		if err != nil {
+			writeError(w, toApiError(err))
+			return
+		}
+
+		writeData(w, http.StatusOK, report)
 		return
 	}
 
-	//check if we sent message with same id previously
-	_, err = ns.redisClient.Get(ctx, msgKey).Result()
-	if err == nil { //message found, don't sent it again
-		w.WriteHeader(http.StatusConflict)
-		fmt.Fprintf(w, "existing message, not sending again")
+	if rle := ns.checkRateLimits(ctx, apiUser, msg); rle != nil {
+		writeRateLimitError(w, rle)
 		return
 	}
 
-	//message not stored, let's store it if it has expiration set
-	if exp > 0 {
-		_, err = ns.redisClient.Set(ctx, msgKey, msg, exp).Result()
-		if err != nil {
-			w.WriteHeader(http.StatusAccepted)
-			fmt.Fprintf(w, "message accepted but unable to store")
-			log.Println(err)
+	result, status, apiErr := ns.acceptMessage(ctx, apiUser, msg)
+	if apiErr != nil {
+		writeError(w, apiErr)
+		return
+	}
+
+	if status == http.StatusConflict {
+		writeResponse(w, status, apiResponse{
+			Data:  result,
+			Error: newApiError(status, errDuplicateMessage, "message %s was sent before", result.Key),
+		})
+		return
+	}
+
+	writeData(w, status, result)
+}
+
+// prepareMessage validates the message and renders its template.
+func (ns *notificationServer) prepareMessage(ctx context.Context, msg messageBody) (messageBody, *apiError) {
+	if err := msg.Validate(); err != nil {
+		return msg, newApiError(http.StatusBadRequest, errInvalidMessage, "%v", err)
+	}
+
+	for _, t := range msg.AllTargets() {
+		getUsers, ok := ns.userGetters[t.Type]
+		if !ok {
+			return msg, newApiError(http.StatusNotImplemented, errUnknownTargetType, "%s target type not implemented yet", t.Type)
+		}
+
+		if ec, ok := getUsers.(EnvironmentChecker); ok && !ec.HasEnvironment(t.Environment) {
+			return msg, newApiError(http.StatusBadRequest, errEnvironmentNotConfigured, "Environment %v not configured", t.Environment)
+		}
+
+		if _, ok := getUsers.(TargetUserGetter); !ok && len(t.Roles) > 0 {
+			return msg, newApiError(http.StatusBadRequest, errInvalidMessage, "%s targets can't be filtered by role", t.Type)
+		}
+
+		if rc, ok := getUsers.(RoleChecker); ok {
+			if err := rc.CheckRoles(t); err != nil {
+				return msg, newApiError(http.StatusBadRequest, errInvalidMessage, "%s target: %v", t.Type, err)
+			}
 		}
 	}
 
-	//retrieve recipient user names based on target
-	var users []string
-	if getUsers, ok := ns.userGetters[msg.Target.Type]; ok {
-		users, err = getUsers.Get(msg.Target.Environment, msg.Target.Id)
-		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			fmt.Fprintf(w, "Error retrieving users: %v", err.Error())
-			return
+	for _, a := range msg.Actions {
+		if !ns.isAllowedActionURL(a.URL) {
+			return msg, newApiError(http.StatusBadRequest, errInvalidMessage, "url scheme of action %s not allowed, use one of %s", a.Label, strings.Join(ns.actionURLSchemes, ", "))
 		}
-	} else {
-		w.WriteHeader(http.StatusNotImplemented)
-		fmt.Fprintf(w, "%s target type not implemented yet\n", msg.Target.Type)
-		return
 	}
 
-	//get destination adress/number for each user from redis
-	subScriptions := make(map[string]Subscription)
-	for _, u := range users {
-		fmt.Printf("Finding contact info for %v\n", u)
-		ciString, err := ns.redisClient.Get(ctx, u).Result()
-		if err != nil {
-			fmt.Println("No info found")
-			continue
+	msg, err := ns.applyTemplate(ctx, msg)
+	if err != nil {
+		log.Println(err)
+		return msg, toApiError(err)
+	}
+
+	return msg, nil
+}
+
+// acceptMessage claims a prepared message and dispatches or schedules it. A
+// duplicate returns the result of the original with http.StatusConflict.
+func (ns *notificationServer) acceptMessage(ctx context.Context, apiUser string, msg messageBody) (sendResult, int, *apiError) {
+	//claim the message, this fails if we sent a message with the same key previously
+	record, claimed, err := ns.claimMessage(ctx, apiUser, msg)
+	if err != nil {
+		log.Println(err)
+		return sendResult{}, http.StatusInternalServerError, newApiError(http.StatusInternalServerError, errInternal, "Unable to store message: %v", err.Error())
+	}
+
+	if !claimed { //message found, don't sent it again
+		return ns.getSendResult(ctx, record, true), http.StatusConflict, nil
+	}
+
+	switch {
+	case msg.IsScheduled():
+		err = ns.scheduleMessage(ctx, record)
+	case record.State == messageResolving:
+		err = ns.resolveInBackground(ctx, record)
+	default:
+		record, err = ns.dispatchMessage(ctx, record)
+	}
+	if err != nil && record.Queued > 0 {
+		//some recipients got the message, keep the claim so submitting it again doesn't send it to them twice
+		reason := err.Error()
+		if _, err := ns.changeMessage(ctx, record.Key, func(stored *messageRecord) error {
+			stored.State = messageFailed
+			stored.Error = reason
+			stored.Targets = record.Targets
+			stored.Recipients = record.Recipients
+			stored.Queued = record.Queued
+			return nil
+		}); err != nil {
+			log.Println(err)
 		}
 
-		var ci Subscription
-		err = json.Unmarshal([]byte(ciString), &ci)
-		if err == nil {
-			subScriptions[u] = ci
+		apiErr := toApiError(err)
+		return sendResult{}, apiErr.Status, apiErr
+	}
+	if err != nil {
+		//nothing was sent, give up the claim so the message can be submitted again
+		if err := ns.releaseMessage(ctx, record.Key); err != nil {
+			log.Println(err)
+		}
+
+		apiErr := toApiError(err)
+		return sendResult{}, apiErr.Status, apiErr
+	}
+
+	return ns.getSendResult(ctx, record, false), http.StatusAccepted, nil
+}
+
+// dispatchMessage resolves the recipients of a claimed message and queues a
+// delivery for every address they subscribed with.
+func (ns *notificationServer) dispatchMessage(ctx context.Context, record messageRecord) (messageRecord, error) {
+	msg := record.Message
+
+	if ns.isStreamed(msg) {
+		return ns.dispatchStreamed(ctx, record)
+	}
+
+	//retrieve recipient user names based on the targets
+	users, targets, err := ns.resolveTargets(msg)
+	record.Targets = targets
+	if err != nil {
+		return record, err
+	}
+
+	record.Recipients = len(users)
+
+	//remember who got the message, follow-ups go to the same users
+	if err := ns.storeRecipients(ctx, record.Key, targetUsernames(users)); err != nil {
+		log.Println(err)
+	}
+
+	n := ns.messageNotification(ctx, record)
+
+	record.Queued, err = ns.queueDeliveries(ctx, record.Key, users, n)
+	if err != nil {
+		return record, err
+	}
+
+	return ns.completeDispatch(ctx, record), nil
+}
+
+// messageNotification returns the notification for the recipients of a
+// message, threaded by the message key.
+func (ns *notificationServer) messageNotification(ctx context.Context, record messageRecord) notification {
+	msg := record.Message
+
+	n := msg.Notification()
+	n.Thread = record.Key
+
+	//templates are rendered again for every recipient that has target details
+	if msg.Template != "" {
+		if mt, err := ns.getTemplate(ctx, msg.Template); err == nil {
+			n.template = &mt
+			n.variables = msg.Variables
+		} else {
+			log.Printf("Unable to load template %s for target details: %v\n", msg.Template, err)
 		}
 	}
 
+	return n
+}
+
+// completeDispatch schedules the escalation of a dispatched message and
+// stores the outcome.
+func (ns *notificationServer) completeDispatch(ctx context.Context, record messageRecord) messageRecord {
+	msg := record.Message
+
 	//check if there are any recipients
-	if len(subScriptions) == 0 {
-		log.Println("Message send to target without recipients")
-		fmt.Fprintf(w, "No recipients found for %s with id %s", msg.Target.Type, msg.Target.Id)
+	if record.Queued == 0 {
+		log.Printf("Message %s sent to targets without recipients\n", record.Key)
+	}
+
+	if msg.RequireAck {
+		deadline := time.Now().Add(msg.EscalationDelay(ns.ackEscalateAfter))
+		if err := ns.scheduleEscalation(ctx, record, deadline); err != nil {
+			log.Println(err)
+		} else {
+			record.AckDeadline = &deadline
+		}
+	}
+
+	//follow-ups of a message that was claimed as dispatched may have changed the record in the meantime
+	stored, err := ns.changeMessage(ctx, record.Key, func(stored *messageRecord) error {
+		if stored.State != messageResolved {
+			stored.State = record.State
+		}
+		stored.Targets = record.Targets
+		stored.Recipients = record.Recipients
+		stored.Queued = record.Queued
+		stored.AckDeadline = record.AckDeadline
+		return nil
+	})
+	if err != nil {
+		log.Println(err)
+		return record
+	}
+
+	return stored
+}
+
+// queueDeliveries queues a delivery of the notification for every address the
+// users subscribed with and returns the number of deliveries queued. The
+// delivery status is recorded under the given key. Messages that request
+// acknowledgement only go to the ack address types first.
+func (ns *notificationServer) queueDeliveries(ctx context.Context, key string, users []targetUser, n notification) (int, error) {
+	return ns.queueDeliveriesTo(ctx, key, users, n, func(ci Subscription, addressType string) bool {
+		return !n.RequireAck || ns.isFirstAckAddressType(ci, addressType)
+	})
+}
+
+// queueDeliveriesTo queues the deliveries for the address types include
+// returns true for.
+func (ns *notificationServer) queueDeliveriesTo(ctx context.Context, key string, users []targetUser, n notification, include func(Subscription, string) bool) (int, error) {
+	//get destination adress/number for each user from redis
+	subScriptions := make(map[string]Subscription)
+	recipients := make(map[string]targetUser)
+	for _, tu := range users {
+		u := tu.Username
+		recipients[u] = tu
+
+		ci, err := ns.getSubscription(ctx, u)
+		if err == redis.Nil {
+			ns.recordDeliveryStatus(ctx, key, deliveryStatus{Username: u, Roles: tu.Roles, Status: deliverySkipped, Error: "no subscription"})
+			continue
+		}
+		if err != nil {
+			ns.recordDeliveryStatus(ctx, key, deliveryStatus{Username: u, Roles: tu.Roles, Status: deliverySkipped, Error: "unreadable subscription"})
+			continue
+		}
+		subScriptions[u] = ci
 	}
 
-	//and then sent it
-	for _, ci := range subScriptions {
+	//and queue it for delivery
+	queued := 0
+	for u, ci := range subScriptions {
+		n := n.ForRecipient(recipients[u].Details)
 		for addressType, address := range ci.Addresses {
-			if address != "" {
-				if sender, ok := ns.notificationSenders[addressType]; ok {
-					go sender.Send(address, msg.Subject, msg.Message)
+			if address != "" && include(ci, addressType) {
+				if _, ok := ns.notificationSenders[addressType]; ok {
+					if ci.IsDigested(addressType, n) {
+						err := ns.bufferDigest(ctx, key, u, addressType, ci.DigestMode(addressType), n)
+						if err != nil {
+							return queued, fmt.Errorf("Error buffering message for digest: %v", err.Error())
+						}
+						ns.recordDeliveryStatus(ctx, key, deliveryStatus{Username: u, AddressType: addressType, Roles: recipients[u].Roles, Status: deliveryDigest})
+						queued++
+						continue
+					}
 
-					_, err := ns.redisClient.Do(ctx, "HINCRBY", "counters", addressType, 1).Result()
+					d := newDelivery(key, u, addressType, address, n)
+					d.Roles = recipients[u].Roles
+					ns.addAck(&d)
+
+					err := ns.queueDelivery(ctx, ci, d)
 					if err != nil {
-						log.Println(err)
+						return queued, fmt.Errorf("Error queueing message: %v", err.Error())
 					}
-
+					queued++
 				} else {
 					log.Printf("Address type %s not valid\n", addressType)
+					ns.recordDeliveryStatus(ctx, key, deliveryStatus{Username: u, AddressType: addressType, Roles: recipients[u].Roles, Status: deliverySkipped, Error: "address type not supported"})
 				}
 			}
 		}
 	}
 
-	fmt.Fprintf(w, "message sent")
+	return queued, nil
+}
+
+// getSubscription returns the subscription of a user. redis.Nil is returned
+// when the user isn't subscribed.
+func (ns *notificationServer) getSubscription(ctx context.Context, username string) (Subscription, error) {
+	var ci Subscription
+
+	fmt.Printf("Finding contact info for %v\n", username)
+	ciString, err := ns.redisClient.Get(ctx, username).Result()
+	if err != nil {
+		if err == redis.Nil {
+			fmt.Println("No info found")
+		}
+		return ci, err
+	}
+
+	err = json.Unmarshal([]byte(ciString), &ci)
+	return ci, err
+}
+
+// getTargetUsers returns the users of a target from the richest interface
+// the user getter implements.
+func getTargetUsers(getUsers UserGetter, t messageTarget) ([]targetUser, error) {
+	if tg, ok := getUsers.(TargetUserGetter); ok {
+		return tg.GetTargetUsers(t)
+	}
+
+	names, err := getUsers.Get(t.Environment, t.Id)
+	return usersByName(names), err
+}
+
+// resolveTargets returns the recipients of all targets of the message, every
+// user only once with the roles matched in any of the targets, and the
+// result of resolving each target. It only fails when none of the targets
+// could be resolved.
+func (ns *notificationServer) resolveTargets(msg messageBody) ([]targetUser, []targetResult, error) {
+	var (
+		users   []targetUser
+		results []targetResult
+		failed  int
+	)
+	seen := make(map[string]int)
+
+	for _, t := range msg.AllTargets() {
+		result := targetResult{Target: t}
+
+		getUsers, ok := ns.userGetters[t.Type]
+		if !ok {
+			result.Error = fmt.Sprintf("%s target type not implemented yet", t.Type)
+			results = append(results, result)
+			failed++
+			continue
+		}
+
+		targetUsers, err := getTargetUsers(getUsers, t)
+		if err != nil {
+			log.Printf("Error retrieving users for %s: %v\n", t, err)
+			result.Error = err.Error()
+			results = append(results, result)
+			failed++
+			continue
+		}
+
+		result.Users = len(targetUsers)
+		results = append(results, result)
+
+		for _, u := range targetUsers {
+			if i, ok := seen[u.Username]; ok {
+				users[i].addRoles(u.Roles...)
+				users[i].addDetails(u.Details)
+				continue
+			}
+			seen[u.Username] = len(users)
+			users = append(users, u)
+		}
+	}
+
+	if failed == len(results) {
+		return nil, results, newApiError(http.StatusInternalServerError, errTargetResolutionFailed, "Error retrieving users: %v", results[0].Error)
+	}
+
+	return users, results, nil
 }
 
 func (ns *notificationServer) subscribeHandler(w http.ResponseWriter, r *http.Request) {
@@ -203,7 +654,23 @@ func (ns *notificationServer) subscribeHandler(w http.ResponseWriter, r *http.Re
 
 	//get new subscribtion info
 	newSub := Subscription{
-		Addresses: make(map[string]string),
+		Addresses:         make(map[string]string),
+		Delivery:          make(map[string]string),
+		CriticalImmediate: r.PostFormValue("critical-immediate") != "",
+	}
+
+	if start, end := r.PostFormValue("quiet-start"), r.PostFormValue("quiet-end"); start != "" || end != "" {
+		qh := quietHours{
+			Start:    start,
+			End:      end,
+			Timezone: r.PostFormValue("quiet-timezone"),
+		}
+
+		if err := qh.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newSub.QuietHours = &qh
 	}
 
 	for senderName, sender := range ns.notificationSenders {
@@ -217,6 +684,10 @@ func (ns *notificationServer) subscribeHandler(w http.ResponseWriter, r *http.Re
 			}
 
 			newSub.Addresses[senderName] = address
+
+			if mode := r.PostFormValue("delivery-" + senderName); isDigestMode(mode) && mode != digestImmediate {
+				newSub.Delivery[senderName] = mode
+			}
 		}
 	}
 
@@ -233,7 +704,7 @@ func (ns *notificationServer) subscribeHandler(w http.ResponseWriter, r *http.Re
 	for newAddrType, newAddr := range newSub.Addresses {
 		if oldAddr, found := existingSub.Addresses[newAddrType]; !found || ((found && oldAddr != newAddr) && newAddr != "") {
 			if sender, ok := ns.notificationSenders[newAddrType]; ok {
-				go sender.Send(newAddr, ns.welcomeSubject, ns.welcomeMessage)
+				go sender.Send(newAddr, notification{Subject: ns.welcomeSubject, Message: ns.welcomeMessage, Severity: severityInfo})
 			} else {
 				log.Printf("Address type %s not valid\n", newAddrType)
 			}
@@ -243,7 +714,7 @@ func (ns *notificationServer) subscribeHandler(w http.ResponseWriter, r *http.Re
 	for oldAddrType, oldAddr := range existingSub.Addresses {
 		if newAddr, found := newSub.Addresses[oldAddrType]; !found || ((found && newAddr != oldAddr) && oldAddr != "") {
 			if sender, ok := ns.notificationSenders[oldAddrType]; ok {
-				go sender.Send(oldAddr, ns.goodbyeSubject, ns.goodbyeMessage)
+				go sender.Send(oldAddr, notification{Subject: ns.goodbyeSubject, Message: ns.goodbyeMessage, Severity: severityInfo})
 			} else {
 				log.Printf("Address type %s not valid\n", oldAddrType)
 			}
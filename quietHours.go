@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+	_ "time/tzdata" //subscribers can pick any timezone, also when the os has no zoneinfo
+)
+
+// quietHours is a daily window in which a subscriber doesn't want to be
+// disturbed. A window that ends before it starts runs past midnight.
+type quietHours struct {
+	Start    string `json:"start"`
+	End      string `json:"end"`
+	Timezone string `json:"timezone,omitempty"`
+}
+
+func (q quietHours) Validate() error {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return fmt.Errorf("invalid start of quiet hours %q, use hh:mm", q.Start)
+	}
+
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return fmt.Errorf("invalid end of quiet hours %q, use hh:mm", q.End)
+	}
+
+	if start.Equal(end) {
+		return fmt.Errorf("quiet hours start and end at the same time")
+	}
+
+	if _, err := time.LoadLocation(q.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", q.Timezone)
+	}
+
+	return nil
+}
+
+// Until returns the end of the quiet hours when t falls within them.
+func (q quietHours) Until(t time.Time) (time.Time, bool) {
+	if q.Validate() != nil {
+		return time.Time{}, false
+	}
+
+	loc, _ := time.LoadLocation(q.Timezone)
+	start, _ := time.Parse("15:04", q.Start)
+	end, _ := time.Parse("15:04", q.End)
+
+	local := t.In(loc)
+
+	//the window that started yesterday may still be running
+	for _, day := range []int{-1, 0} {
+		windowStart := time.Date(local.Year(), local.Month(), local.Day()+day, start.Hour(), start.Minute(), 0, 0, loc)
+		windowEnd := time.Date(local.Year(), local.Month(), local.Day()+day, end.Hour(), end.Minute(), 0, 0, loc)
+		if !windowEnd.After(windowStart) {
+			windowEnd = time.Date(local.Year(), local.Month(), local.Day()+day+1, end.Hour(), end.Minute(), 0, 0, loc)
+		}
+
+		if !local.Before(windowStart) && local.Before(windowEnd) {
+			return windowEnd, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+// canOverrideQuietHours tells if the api user may send messages that are
+// delivered during quiet hours.
+func (ns *notificationServer) canOverrideQuietHours(apiUser string) bool {
+	for _, u := range ns.quietHoursOverrideUsers {
+		if u == apiUser {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authorizeMessage checks if the api user may send the message.
+func (ns *notificationServer) authorizeMessage(apiUser string, msg messageBody) *apiError {
+	if msg.OverrideQuietHours && !ns.canOverrideQuietHours(apiUser) {
+		return newApiError(http.StatusForbidden, errQuietHoursOverrideForbidden, "api user %s may not override quiet hours", apiUser)
+	}
+
+	return nil
+}
+
+// deferDelivery queues a delivery that is held until the quiet hours of the
+// recipient end.
+func (ns *notificationServer) deferDelivery(ctx context.Context, d delivery, until time.Time) error {
+	if err := ns.deliveryQueue.Add(ctx, d.Id, d, until); err != nil {
+		return err
+	}
+
+	ns.recordDelivery(ctx, d, deliveryDeferred)
+	return nil
+}
+
+// queueDelivery queues the delivery right away, or holds it when the
+// recipient has quiet hours and the notification doesn't override them.
+func (ns *notificationServer) queueDelivery(ctx context.Context, ci Subscription, d delivery) error {
+	if ci.QuietHours != nil && !d.Notification.OverrideQuietHours {
+		if until, quiet := ci.QuietHours.Until(time.Now()); quiet {
+			return ns.deferDelivery(ctx, d, until)
+		}
+	}
+
+	return ns.enqueueDelivery(ctx, d)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestQuietHoursUntil(t *testing.T) {
+	ams, err := time.LoadLocation("Europe/Amsterdam")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	night := quietHours{Start: "22:00", End: "07:00", Timezone: "Europe/Amsterdam"}
+	lunch := quietHours{Start: "12:00", End: "14:00", Timezone: "Europe/Amsterdam"}
+
+	tests := []struct {
+		name   string
+		q      quietHours
+		t      time.Time
+		want   time.Time
+		within bool
+	}{
+		{"before the window", night, time.Date(2023, 6, 1, 21, 59, 0, 0, ams), time.Time{}, false},
+		{"start of the window", night, time.Date(2023, 6, 1, 22, 0, 0, 0, ams), time.Date(2023, 6, 2, 7, 0, 0, 0, ams), true},
+		{"before midnight", night, time.Date(2023, 6, 1, 23, 30, 0, 0, ams), time.Date(2023, 6, 2, 7, 0, 0, 0, ams), true},
+		{"after midnight", night, time.Date(2023, 6, 2, 3, 0, 0, 0, ams), time.Date(2023, 6, 2, 7, 0, 0, 0, ams), true},
+		{"end of the window", night, time.Date(2023, 6, 2, 7, 0, 0, 0, ams), time.Time{}, false},
+		{"during the day", night, time.Date(2023, 6, 2, 12, 0, 0, 0, ams), time.Time{}, false},
+		{"other timezone", night, time.Date(2023, 6, 1, 21, 0, 0, 0, time.UTC), time.Date(2023, 6, 2, 7, 0, 0, 0, ams), true},
+		{"window within a day", lunch, time.Date(2023, 6, 1, 13, 0, 0, 0, ams), time.Date(2023, 6, 1, 14, 0, 0, 0, ams), true},
+		{"after a window within a day", lunch, time.Date(2023, 6, 1, 23, 0, 0, 0, ams), time.Time{}, false},
+		{"default timezone", quietHours{Start: "22:00", End: "07:00"}, time.Date(2023, 6, 1, 23, 0, 0, 0, time.UTC), time.Date(2023, 6, 2, 7, 0, 0, 0, time.UTC), true},
+		{"invalid", quietHours{Start: "22", End: "07:00"}, time.Date(2023, 6, 1, 23, 0, 0, 0, time.UTC), time.Time{}, false},
+		//the clocks go forward at 02:00 on 26 March 2023, the night is an hour shorter
+		{"dst starts", night, time.Date(2023, 3, 25, 23, 0, 0, 0, ams), time.Date(2023, 3, 26, 5, 0, 0, 0, time.UTC), true},
+		{"dst started", night, time.Date(2023, 3, 26, 4, 0, 0, 0, ams), time.Date(2023, 3, 26, 5, 0, 0, 0, time.UTC), true},
+		//the clocks go back at 03:00 on 29 October 2023, the night is an hour longer
+		{"dst ends", night, time.Date(2023, 10, 28, 23, 0, 0, 0, ams), time.Date(2023, 10, 29, 6, 0, 0, 0, time.UTC), true},
+		{"dst ended", night, time.Date(2023, 10, 29, 5, 0, 0, 0, ams), time.Date(2023, 10, 29, 6, 0, 0, 0, time.UTC), true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, within := tt.q.Until(tt.t)
+			if within != tt.within || !got.Equal(tt.want) {
+				t.Errorf("Until(%v) = %v, %v, want %v, %v", tt.t, got, within, tt.want, tt.within)
+			}
+		})
+	}
+}
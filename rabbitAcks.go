@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/wagslane/go-rabbitmq"
+)
+
+// ConsumeRabbitAcks acknowledges messages with the ack replies of rabbit
+// based channels. A reply holds the ack token, either as the whole body or
+// as {"ackToken": "<token>"}.
+func (ns *notificationServer) ConsumeRabbitAcks(uri, queue string) error {
+	conn, err := rabbitmq.NewConn(uri)
+	if err != nil {
+		return err
+	}
+
+	_, err = rabbitmq.NewConsumer(conn, func(d rabbitmq.Delivery) rabbitmq.Action {
+		token := rabbitAckToken(d.Body)
+
+		_, apiErr := ns.acknowledge(context.Background(), token, ackViaRabbit)
+		if apiErr == nil {
+			return rabbitmq.Ack
+		}
+
+		log.Printf("Unable to process rabbit ack: %v\n", apiErr)
+		if apiErr.Status == http.StatusInternalServerError {
+			return rabbitmq.NackRequeue
+		}
+		return rabbitmq.NackDiscard
+	}, queue, rabbitmq.WithConsumerOptionsQueueDurable)
+
+	return err
+}
+
+func rabbitAckToken(body []byte) string {
+	var reply struct {
+		AckToken string `json:"ackToken"`
+	}
+
+	if err := json.Unmarshal(body, &reply); err == nil && reply.AckToken != "" {
+		return reply.AckToken
+	}
+
+	return strings.TrimSpace(string(body))
+}
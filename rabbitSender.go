@@ -14,10 +14,14 @@ type rabbitSender struct {
 	publisher    *rabbitmq.Publisher
 	exchange     string
 	template     string
+	format       string
 	validationRE string
 }
 
-func NewRabbitSender(uri, exchange, template string) *rabbitSender {
+// NewRabbitSender creates a sender that publishes the message rendered with
+// template. With format text markdown messages are stripped to plain text,
+// with format markdown they are passed as they are.
+func NewRabbitSender(uri, exchange, template, format string) *rabbitSender {
 	conn, err := rabbitmq.NewConn(uri)
 	if err != nil {
 		log.Fatal(err)
@@ -32,15 +36,16 @@ func NewRabbitSender(uri, exchange, template string) *rabbitSender {
 		publisher:    publisher,
 		exchange:     exchange,
 		template:     template,
+		format:       format,
 		validationRE: "^(?:0|(?:\\+|00) ?31 ?)(?:(?:[1-9] ?(?:[0-9] ?){8})|(?:6 ?-? ?[1-9] ?(?:[0-9] ?){7})|(?:[1,2,3,4,5,7,8,9]\\d ?-? ?[1-9] ?(?:[0-9] ?){6})|(?:[1,2,3,4,5,7,8,9]\\d{2} ?-? ?[1-9] ?(?:[0-9] ?){5}))$",
 	}
 }
 
-func (r *rabbitSender) Send(dest, subject, message string) error {
+func (r *rabbitSender) Send(dest string, n notification) error {
 	if dest == "" {
 		return fmt.Errorf("No destination address given")
 	}
-	log.Printf("sending message to %s. Subject: %v, message: %v\n", dest, subject, message)
+	log.Printf("sending message to %s. Subject: %v, message: %v\n", dest, n.Subject, n.Message)
 	payloadTemplate, err := template.New("msg").Parse(r.template)
 	if err != nil {
 		return err
@@ -50,18 +55,35 @@ func (r *rabbitSender) Send(dest, subject, message string) error {
 		Destination string
 		Subject     string
 		Message     string
+		Severity    string
+		Thread      string
+		FollowUp    string
+		AckURL      string
+		AckToken    string
+		Actions     []messageAction
+		Target      map[string]interface{}
 	}{
 		Destination: dest,
-		Subject:     subject,
-		Message:     message,
+		Subject:     n.Subject,
+		Message:     n.Render(r.format),
+		Severity:    n.Severity,
+		Thread:      n.Thread,
+		FollowUp:    n.FollowUp,
+		AckURL:      n.AckURL,
+		AckToken:    n.AckToken,
+		Actions:     n.Actions,
+		Target:      n.Target,
 	}
 
 	var payload bytes.Buffer
-	payloadTemplate.Execute(&payload, payloadData)
+	if err := payloadTemplate.Execute(&payload, payloadData); err != nil {
+		return err
+	}
 
 	err = r.publisher.Publish(payload.Bytes(), []string{""}, rabbitmq.WithPublishOptionsExchange(r.exchange))
 	if err != nil {
-		log.Fatal(err)
+		log.Println("Unable to publish message: ", err)
+		return err
 	}
 	return nil
 }
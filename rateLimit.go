@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	rateLimitApiUser = "apiuser"
+	rateLimitTarget  = "target"
+
+	rateLimitCountersKey = "counters-ratelimit"
+)
+
+// rateLimit is a token bucket that holds Requests tokens and refills them
+// evenly over Period. A zero rateLimit doesn't limit anything.
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// parseRateLimit parses a limit written as <requests>/<period>, for example
+// 60/1m. An empty string is no limit.
+func parseRateLimit(s string) (rateLimit, error) {
+	if s == "" {
+		return rateLimit{}, nil
+	}
+
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) != 2 {
+		return rateLimit{}, fmt.Errorf("invalid rate limit %q, use <requests>/<period>", s)
+	}
+
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests < 1 {
+		return rateLimit{}, fmt.Errorf("invalid number of requests in rate limit %q", s)
+	}
+
+	period, err := time.ParseDuration(parts[1])
+	if err != nil || period <= 0 {
+		return rateLimit{}, fmt.Errorf("invalid period in rate limit %q", s)
+	}
+
+	return rateLimit{Requests: requests, Period: period}, nil
+}
+
+func (l rateLimit) IsSet() bool {
+	return l.Requests > 0
+}
+
+// takeTokensScript takes a token from every bucket in KEYS, or from none of
+// them when one is empty. ARGV holds the current time in ms followed by the
+// size and refill period in ms of every bucket. It returns the position of
+// the empty bucket that takes longest to refill and the ms until it holds a
+// token again, or 0 and 0 when the tokens were taken.
+var takeTokensScript = redis.NewScript(`
+local now = tonumber(ARGV[1])
+local tokens = {}
+local exceeded = 0
+local retry = 0
+
+for i, key in ipairs(KEYS) do
+	local size = tonumber(ARGV[i*2])
+	local period = tonumber(ARGV[i*2+1])
+
+	local bucket = redis.call("HMGET", key, "tokens", "ts")
+	local t = tonumber(bucket[1])
+	local ts = tonumber(bucket[2])
+	if t == nil or ts == nil then
+		t = size
+		ts = now
+	end
+
+	t = math.min(size, t + math.max(0, now - ts) * size / period)
+	tokens[i] = t
+
+	if t < 1 then
+		local wait = math.ceil((1 - t) * period / size)
+		if wait > retry then
+			retry = wait
+			exceeded = i
+		end
+	end
+end
+
+if exceeded > 0 then
+	return {exceeded, retry}
+end
+
+for i, key in ipairs(KEYS) do
+	redis.call("HMSET", key, "tokens", tostring(tokens[i] - 1), "ts", now)
+	redis.call("PEXPIRE", key, ARGV[i*2+1])
+end
+
+return {0, 0}
+`)
+
+// rateLimitError is returned when a request exceeds one of the rate limits.
+type rateLimitError struct {
+	Limit      string
+	Name       string
+	RetryAfter time.Duration
+}
+
+func (e rateLimitError) Error() string {
+	return fmt.Sprintf("Rate limit for %s %s exceeded, retry after %v", e.Limit, e.Name, e.RetryAfter)
+}
+
+// RetryAfterSeconds returns the wait for the Retry-After header, rounded up.
+func (e rateLimitError) RetryAfterSeconds() int {
+	return int((e.RetryAfter + time.Second - 1) / time.Second)
+}
+
+func (ns *notificationServer) apiUserRateLimit(apiUser string) rateLimit {
+	if l, ok := ns.rateLimitApiUsers[apiUser]; ok {
+		return l
+	}
+
+	return ns.rateLimitApiUser
+}
+
+// checkRateLimits takes a token from the bucket of the api user and of every
+// target of the message. Nothing is taken when one of the buckets is empty,
+// in that case the exceeded limit is returned and the rejection is counted.
+// When redis can't be reached the limits aren't enforced.
+func (ns *notificationServer) checkRateLimits(ctx context.Context, apiUser string, msg messageBody) *rateLimitError {
+	var (
+		keys   []string
+		args   []interface{}
+		limits []string
+		names  []string
+	)
+
+	add := func(limit, name string, l rateLimit) {
+		if !l.IsSet() {
+			return
+		}
+
+		key := "ratelimit-" + limit + "-" + name
+		for _, k := range keys {
+			if k == key {
+				return
+			}
+		}
+
+		keys = append(keys, key)
+		args = append(args, l.Requests, l.Period.Milliseconds())
+		limits = append(limits, limit)
+		names = append(names, name)
+	}
+
+	add(rateLimitApiUser, apiUser, ns.apiUserRateLimit(apiUser))
+	for _, t := range msg.AllTargets() {
+		add(rateLimitTarget, t.String(), ns.rateLimitTarget)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	args = append([]interface{}{time.Now().UnixNano() / int64(time.Millisecond)}, args...)
+
+	result, err := takeTokensScript.Run(ctx, ns.redisClient, keys, args...).Int64Slice()
+	if err != nil {
+		log.Printf("Unable to check rate limits: %v\n", err)
+		return nil
+	}
+
+	if result[0] == 0 {
+		return nil
+	}
+
+	i := result[0] - 1
+	if err := ns.redisClient.HIncrBy(ctx, rateLimitCountersKey, limits[i], 1).Err(); err != nil {
+		log.Println(err)
+	}
+
+	return &rateLimitError{
+		Limit:      limits[i],
+		Name:       names[i],
+		RetryAfter: time.Duration(result[1]) * time.Millisecond,
+	}
+}
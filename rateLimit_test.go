@@ -0,0 +1,40 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    rateLimit
+		wantErr bool
+	}{
+		{"", rateLimit{}, false},
+		{"60/1m", rateLimit{Requests: 60, Period: time.Minute}, false},
+		{"1/1h30m", rateLimit{Requests: 1, Period: 90 * time.Minute}, false},
+		{"10/500ms", rateLimit{Requests: 10, Period: 500 * time.Millisecond}, false},
+		{"60", rateLimit{}, true},
+		{"60/", rateLimit{}, true},
+		{"/1m", rateLimit{}, true},
+		{"x/1m", rateLimit{}, true},
+		{"0/1m", rateLimit{}, true},
+		{"-1/1m", rateLimit{}, true},
+		{"60/minute", rateLimit{}, true},
+		{"60/0s", rateLimit{}, true},
+		{"60/-1m", rateLimit{}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseRateLimit(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseRateLimit(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("parseRateLimit(%q) = %+v, want %+v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// redisQueue is a persistent queue shared by all instances. Items are kept in a
+// sorted set scored by the time they become due and their payloads in a hash.
+// Claiming an item leases it by moving its score into the future, so an item
+// claimed by an instance that crashes becomes due again once the lease ends.
+type redisQueue struct {
+	redisClient *redis.Client
+	name        string
+}
+
+// the time an instance gets to handle a claimed item before another instance takes over
+const queueLease = 5 * time.Minute
+
+var claimScript = redis.NewScript(`
+local ids = redis.call('ZRANGEBYSCORE', KEYS[1], '-inf', ARGV[1], 'LIMIT', 0, 1)
+if #ids == 0 then
+	return false
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ids[1])
+local payload = redis.call('HGET', KEYS[2], ids[1])
+if not payload then
+	redis.call('ZREM', KEYS[1], ids[1])
+	return {ids[1], ''}
+end
+return {ids[1], payload}
+`)
+
+func NewRedisQueue(rc *redis.Client, name string) *redisQueue {
+	return &redisQueue{
+		redisClient: rc,
+		name:        "queue-" + name,
+	}
+}
+
+func (q *redisQueue) itemsKey() string {
+	return q.name + "-items"
+}
+
+// Add stores the item and makes it due at the given time. Adding an id that is
+// already queued replaces its payload and due time.
+func (q *redisQueue) Add(ctx context.Context, id string, payload interface{}, due time.Time) error {
+	_, err := q.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSet(ctx, q.itemsKey(), id, payload)
+		pipe.ZAdd(ctx, q.name, &redis.Z{Score: float64(due.UnixMilli()), Member: id})
+		return nil
+	})
+
+	return err
+}
+
+// AddNX adds the item unless it is already queued, in which case its payload,
+// due time and lease stay as they are.
+func (q *redisQueue) AddNX(ctx context.Context, id string, payload interface{}, due time.Time) error {
+	_, err := q.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HSetNX(ctx, q.itemsKey(), id, payload)
+		pipe.ZAddNX(ctx, q.name, &redis.Z{Score: float64(due.UnixMilli()), Member: id})
+		return nil
+	})
+
+	return err
+}
+
+var updateScript = redis.NewScript(`
+if not redis.call('ZSCORE', KEYS[1], ARGV[1]) then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+return 1
+`)
+
+// Update replaces the payload and due time of an item that is still queued.
+// redis.Nil is returned when the item was removed, for example because it was
+// cancelled while an instance was working on it.
+func (q *redisQueue) Update(ctx context.Context, id string, payload interface{}, due time.Time) error {
+	updated, err := updateScript.Run(ctx, q.redisClient, []string{q.name, q.itemsKey()},
+		id,
+		strconv.FormatInt(due.UnixMilli(), 10),
+		payload,
+	).Int()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		return redis.Nil
+	}
+
+	return nil
+}
+
+// Claim returns the id and payload of an item that is due and leases it for
+// the given duration. redis.Nil is returned when no item is due.
+func (q *redisQueue) Claim(ctx context.Context, lease time.Duration) (string, []byte, error) {
+	now := time.Now()
+	res, err := claimScript.Run(ctx, q.redisClient, []string{q.name, q.itemsKey()},
+		strconv.FormatInt(now.UnixMilli(), 10),
+		strconv.FormatInt(now.Add(lease).UnixMilli(), 10),
+	).Result()
+	if err != nil {
+		return "", nil, err
+	}
+
+	item, ok := res.([]interface{})
+	if !ok || len(item) != 2 {
+		return "", nil, redis.Nil
+	}
+
+	id, _ := item[0].(string)
+	payload, _ := item[1].(string)
+
+	return id, []byte(payload), nil
+}
+
+// Extend moves the end of the lease of a claimed item, unless the item was
+// removed in the meantime.
+func (q *redisQueue) Extend(ctx context.Context, id string, lease time.Duration) error {
+	return q.redisClient.ZAddXX(ctx, q.name, &redis.Z{Score: float64(time.Now().Add(lease).UnixMilli()), Member: id}).Err()
+}
+
+// KeepLeased extends the lease of a claimed item every half lease until the
+// returned function is called, for work that may take longer than the lease.
+func (q *redisQueue) KeepLeased(ctx context.Context, id string, lease time.Duration) func() {
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(lease / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := q.Extend(ctx, id, lease); err != nil {
+					log.Printf("Unable to extend the lease on %s: %v\n", id, err)
+				}
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// Remove deletes the item from the queue.
+func (q *redisQueue) Remove(ctx context.Context, id string) error {
+	_, err := q.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, q.name, id)
+		pipe.HDel(ctx, q.itemsKey(), id)
+		return nil
+	})
+
+	return err
+}
+
+// Get returns the payload of a queued item. redis.Nil is returned when the
+// item isn't queued.
+func (q *redisQueue) Get(ctx context.Context, id string) ([]byte, error) {
+	payload, err := q.redisClient.HGet(ctx, q.itemsKey(), id).Result()
+	return []byte(payload), err
+}
+
+type queueItem struct {
+	Id      string
+	Payload []byte
+	Due     time.Time
+}
+
+// List returns all queued items ordered by the time they are due. Leased items
+// are listed with the time their lease ends.
+func (q *redisQueue) List(ctx context.Context) ([]queueItem, error) {
+	members, err := q.redisClient.ZRangeWithScores(ctx, q.name, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var items []queueItem
+	for _, member := range members {
+		id, _ := member.Member.(string)
+		payload, err := q.Get(ctx, id)
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		items = append(items, queueItem{
+			Id:      id,
+			Payload: payload,
+			Due:     time.UnixMilli(int64(member.Score)),
+		})
+	}
+
+	return items, nil
+}
+
+// Len returns the number of queued items, including the ones that are leased.
+func (q *redisQueue) Len(ctx context.Context) (int64, error) {
+	return q.redisClient.ZCard(ctx, q.name).Result()
+}
+
+// Consume passes the items to handle as they become due until ctx is
+// cancelled, polling the queue every pollInterval while nothing is due. Every
+// instance consumes the queues, the lease makes sure only one of them handles
+// an item. handle removes or reschedules the item, an item it leaves alone is
+// handled again when the lease ends.
+func (q *redisQueue) Consume(ctx context.Context, lease, pollInterval time.Duration, handle func(ctx context.Context, id string, payload []byte)) {
+	for {
+		id, payload, err := q.Claim(ctx, lease)
+		if err != nil {
+			if err != redis.Nil {
+				log.Printf("Unable to claim from %s: %v\n", q.name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(pollInterval):
+			}
+			continue
+		}
+
+		handle(ctx, id, payload)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+type scheduledMessage struct {
+	Key        string      `json:"key"`
+	SendAt     time.Time   `json:"sendAt"`
+	AcceptedBy string      `json:"acceptedBy"`
+	AcceptedAt time.Time   `json:"acceptedAt"`
+	Message    messageBody `json:"message"`
+}
+
+func (ns *notificationServer) scheduleMessage(ctx context.Context, record messageRecord) error {
+	return ns.scheduleQueue.Add(ctx, record.Key, record, *record.Message.SendAt)
+}
+
+// StartScheduler dispatches scheduled messages when they are due until ctx is
+// cancelled.
+func (ns *notificationServer) StartScheduler(ctx context.Context, pollInterval time.Duration) {
+	go ns.scheduleQueue.Consume(ctx, queueLease, pollInterval, ns.dispatchScheduledMessage)
+}
+
+func (ns *notificationServer) dispatchScheduledMessage(ctx context.Context, key string, payload []byte) {
+	var record messageRecord
+	if err := json.Unmarshal(payload, &record); err != nil {
+		log.Printf("Dropping unreadable scheduled message %s: %v\n", key, err)
+		ns.scheduleQueue.Remove(ctx, key)
+		return
+	}
+
+	//count the attempt up front, an instance that dies while dispatching doesn't get to do it afterwards
+	record.Attempts++
+	if err := ns.scheduleQueue.Update(ctx, key, record, time.Now().Add(queueLease)); err != nil {
+		if err != redis.Nil {
+			log.Println(err)
+		}
+		return
+	}
+
+	if !ns.startDispatch(ctx, record) {
+		return
+	}
+
+	log.Printf("Dispatching scheduled message %s\n", key)
+	record.State = messageDispatched
+
+	stop := ns.scheduleQueue.KeepLeased(ctx, key, queueLease)
+	record, err := ns.dispatchMessage(ctx, record)
+	stop()
+
+	if err != nil && record.Attempts < ns.deliveryMaxAttempts {
+		//the lease runs out and the message is tried again
+		log.Printf("Unable to dispatch scheduled message %s (attempt %d): %v\n", key, record.Attempts, err)
+		return
+	}
+
+	if err != nil {
+		log.Printf("Giving up on scheduled message %s after %d attempts: %v\n", key, record.Attempts, err)
+		reason := err.Error()
+		_, err := ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+			stored.State = messageFailed
+			stored.Error = reason
+			stored.Targets = record.Targets
+			return nil
+		})
+		if err != nil {
+			log.Println(err)
+		}
+	}
+
+	if err := ns.scheduleQueue.Remove(ctx, key); err != nil {
+		log.Println(err)
+	}
+}
+
+// startDispatch moves the stored record out of the scheduled state, so the
+// message can't be moved or cancelled while it is sent. It returns false when
+// the message shouldn't be sent: a message that was cancelled or expired is
+// dropped, a message that was moved in the meantime is queued for its new
+// time.
+func (ns *notificationServer) startDispatch(ctx context.Context, record messageRecord) bool {
+	state := messageDispatching
+	if ns.isStreamed(record.Message) {
+		state = messageResolving
+	}
+
+	moved := false
+	current, err := ns.changeMessage(ctx, record.Key, func(stored *messageRecord) error {
+		switch stored.State {
+		case messageScheduled:
+			if !sameTime(stored.Message.SendAt, record.Message.SendAt) {
+				moved = true
+				return fmt.Errorf("scheduled message %s was moved", record.Key)
+			}
+		case messageDispatching, messageResolving:
+			//an earlier attempt failed or the instance that made it went away
+		default:
+			return fmt.Errorf("scheduled message %s is %s", record.Key, stored.State)
+		}
+
+		stored.State = state
+		return nil
+	})
+	if err == nil {
+		return true
+	}
+
+	log.Printf("Not dispatching scheduled message %s: %v\n", record.Key, err)
+	if moved {
+		//the claim may have overwritten the new send time
+		if err := ns.scheduleMessage(ctx, current); err != nil {
+			log.Println(err)
+		}
+		return false
+	}
+
+	if err := ns.scheduleQueue.Remove(ctx, record.Key); err != nil {
+		log.Println(err)
+	}
+	return false
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return a.Equal(*b)
+}
+
+func (ns *notificationServer) getScheduledMessage(ctx context.Context, key string) (messageRecord, error) {
+	var record messageRecord
+
+	payload, err := ns.scheduleQueue.Get(ctx, key)
+	if err != nil {
+		return record, err
+	}
+
+	err = json.Unmarshal(payload, &record)
+	return record, err
+}
+
+func (ns *notificationServer) listScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	items, err := ns.scheduleQueue.List(r.Context())
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	scheduled := []scheduledMessage{}
+	for _, item := range items {
+		var record messageRecord
+		if err := json.Unmarshal(item.Payload, &record); err != nil {
+			log.Println(err)
+			continue
+		}
+
+		//messages that are resolved in the background are due right away
+		sendAt := record.AcceptedAt
+		if record.Message.SendAt != nil {
+			sendAt = *record.Message.SendAt
+		}
+
+		scheduled = append(scheduled, scheduledMessage{
+			Key:        record.Key,
+			SendAt:     sendAt,
+			AcceptedBy: record.AcceptedBy,
+			AcceptedAt: record.AcceptedAt,
+			Message:    record.Message,
+		})
+	}
+
+	writeData(w, http.StatusOK, scheduled)
+}
+
+func (ns *notificationServer) rescheduleHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	ctx := r.Context()
+	key := mux.Vars(r)["key"]
+
+	var body struct {
+		SendAt *time.Time `json:"sendAt"`
+	}
+
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.SendAt == nil {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "sendAt is required"))
+		return
+	}
+
+	if !body.SendAt.After(time.Now()) {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "sendAt must be in the future"))
+		return
+	}
+
+	if _, err := ns.getScheduledMessage(ctx, key); err != nil {
+		writeScheduledError(w, key, err)
+		return
+	}
+
+	//the scheduler only sends the message when the stored send time is still the one it claimed
+	record, err := ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+		if stored.State != messageScheduled {
+			return newApiError(http.StatusConflict, errMessageDispatching, "message %s is being sent", key)
+		}
+
+		stored.Message.SendAt = body.SendAt
+		return nil
+	})
+	if err != nil {
+		writeScheduledError(w, key, err)
+		return
+	}
+
+	if err := ns.scheduleMessage(ctx, record); err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	//keep blocking duplicates until the message expires after the new send time
+	if err := ns.redisClient.Expire(ctx, messageRecordKey(key), record.Message.Validity(ns.defaultValidity)).Err(); err != nil {
+		log.Println(err)
+	}
+
+	writeData(w, http.StatusOK, ns.getSendResult(ctx, record, false))
+}
+
+func (ns *notificationServer) cancelScheduledHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	ctx := r.Context()
+	key := mux.Vars(r)["key"]
+
+	if _, err := ns.getScheduledMessage(ctx, key); err != nil {
+		writeScheduledError(w, key, err)
+		return
+	}
+
+	//the scheduler doesn't start a cancelled message, one it started can't be cancelled anymore
+	_, err := ns.changeMessage(ctx, key, func(stored *messageRecord) error {
+		if stored.State != messageScheduled {
+			return newApiError(http.StatusConflict, errMessageDispatching, "message %s is being sent", key)
+		}
+
+		stored.State = messageCancelled
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		writeScheduledError(w, key, err)
+		return
+	}
+
+	if err := ns.scheduleQueue.Remove(ctx, key); err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	//a cancelled message may be submitted again
+	if err := ns.releaseMessage(ctx, key); err != nil {
+		log.Println(err)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func writeScheduledError(w http.ResponseWriter, key string, err error) {
+	if err == redis.Nil {
+		writeError(w, newApiError(http.StatusNotFound, errScheduledNotFound, "scheduled message %s not found", key))
+		return
+	}
+
+	apiErr := toApiError(err)
+	if apiErr.Status == http.StatusInternalServerError {
+		log.Println(err)
+	}
+	writeError(w, apiErr)
+}
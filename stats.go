@@ -2,33 +2,41 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 type Stats struct {
-	MessagesStored  int64            `json:"messages_stored"`
-	UsersSubscribed int64            `json:"users_subscribed"`
-	MsgSent         map[string]int64 `json:"messages_sent"`
+	MessagesStored   int64            `json:"messages_stored"`
+	UsersSubscribed  int64            `json:"users_subscribed"`
+	DeliveriesQueued int64            `json:"deliveries_queued"`
+	MsgSent          map[string]int64 `json:"messages_sent"`
+	MsgSentSeverity  map[string]int64 `json:"messages_sent_by_severity"`
+	RateLimited      map[string]int64 `json:"requests_rate_limited"`
 }
 
 type StatsCollector struct {
-	redisClient *redis.Client
-
-	MessagesStoredDesc  *prometheus.Desc
-	UsersSubscribedDesc *prometheus.Desc
-	MsgSentDesc         map[string]*prometheus.Desc
+	redisClient   *redis.Client
+	deliveryQueue *redisQueue
+
+	MessagesStoredDesc   *prometheus.Desc
+	UsersSubscribedDesc  *prometheus.Desc
+	DeliveriesQueuedDesc *prometheus.Desc
+	MsgSentDesc          map[string]*prometheus.Desc
+	MsgSentSeverityDesc  *prometheus.Desc
+	RateLimitedDesc      *prometheus.Desc
 }
 
-func NewStatsCollector(rc *redis.Client) *StatsCollector {
+func NewStatsCollector(rc *redis.Client, deliveryQueue *redisQueue) *StatsCollector {
 	labels := prometheus.Labels{}
 	s := &StatsCollector{
-		redisClient: rc,
+		redisClient:   rc,
+		deliveryQueue: deliveryQueue,
 		MessagesStoredDesc: prometheus.NewDesc(prometheus.BuildFQName("cfnotificationservice", "", "messages_stored"),
 			"Number of messages currently stored",
 			nil,
@@ -39,7 +47,22 @@ func NewStatsCollector(rc *redis.Client) *StatsCollector {
 			nil,
 			labels,
 		),
+		DeliveriesQueuedDesc: prometheus.NewDesc(prometheus.BuildFQName("cfnotificationservice", "", "deliveries_queued"),
+			"Number of deliveries waiting to be sent or retried",
+			nil,
+			labels,
+		),
 		MsgSentDesc: make(map[string]*prometheus.Desc),
+		MsgSentSeverityDesc: prometheus.NewDesc(prometheus.BuildFQName("cfnotificationservice", "", "messages_sent_by_severity"),
+			"Number of messages sent per severity",
+			[]string{"severity"},
+			labels,
+		),
+		RateLimitedDesc: prometheus.NewDesc(prometheus.BuildFQName("cfnotificationservice", "", "requests_rate_limited"),
+			"Number of send requests rejected per rate limit",
+			[]string{"limit"},
+			labels,
+		),
 	}
 
 	stats := s.Get(context.Background())
@@ -58,20 +81,39 @@ func NewStatsCollector(rc *redis.Client) *StatsCollector {
 func (s *StatsCollector) Get(ctx context.Context) Stats {
 	var stats Stats
 
-	counterKeys, _ := s.redisClient.HKeys(ctx, "counters").Result()
 	numAllKeys, _ := s.redisClient.DBSize(ctx).Result()
-	msgKeys, _, _ := s.redisClient.Scan(ctx, 0, "msg-*", numAllKeys).Result()
-	numMsgKeys := int64(len(msgKeys))
-	numUsers := numAllKeys - (numMsgKeys + 1) //+1 because counters is a key as well
+	allKeys, _, _ := s.redisClient.Scan(ctx, 0, "*", numAllKeys).Result()
+	numDeliveries, _ := s.deliveryQueue.Len(ctx)
+
+	var numMsgKeys, numUsers int64
+	for _, key := range allKeys {
+		if strings.HasPrefix(key, "msg-") {
+			numMsgKeys++
+		} else if isSubscriptionKey(key) {
+			numUsers++
+		}
+	}
 
 	stats = Stats{
-		MessagesStored:  numMsgKeys,
-		UsersSubscribed: numUsers,
-		MsgSent:         make(map[string]int64),
+		MessagesStored:   numMsgKeys,
+		UsersSubscribed:  numUsers,
+		DeliveriesQueued: numDeliveries,
 	}
 
+	stats.MsgSent = s.getCounters(ctx, "counters")
+	stats.MsgSentSeverity = s.getCounters(ctx, "counters-severity")
+	stats.RateLimited = s.getCounters(ctx, rateLimitCountersKey)
+
+	return stats
+}
+
+func (s *StatsCollector) getCounters(ctx context.Context, key string) map[string]int64 {
+	counters := make(map[string]int64)
+
+	counterKeys, _ := s.redisClient.HKeys(ctx, key).Result()
+
 	for _, counterKey := range counterKeys {
-		counterValString, err := s.redisClient.HGet(ctx, "counters", counterKey).Result()
+		counterValString, err := s.redisClient.HGet(ctx, key, counterKey).Result()
 		if err != nil {
 			counterValString = "0"
 		}
@@ -81,18 +123,21 @@ func (s *StatsCollector) Get(ctx context.Context) Stats {
 			log.Printf("error converting string to number: %v\n", err.Error())
 		}
 
-		stats.MsgSent[counterKey] = int64(counterVal)
+		counters[counterKey] = int64(counterVal)
 	}
 
-	return stats
+	return counters
 }
 
 func (s *StatsCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- s.MessagesStoredDesc
 	ch <- s.UsersSubscribedDesc
+	ch <- s.DeliveriesQueuedDesc
 	for _, counterDesc := range s.MsgSentDesc {
 		ch <- counterDesc
 	}
+	ch <- s.MsgSentSeverityDesc
+	ch <- s.RateLimitedDesc
 }
 
 func (s *StatsCollector) Collect(ch chan<- prometheus.Metric) {
@@ -108,12 +153,41 @@ func (s *StatsCollector) Collect(ch chan<- prometheus.Metric) {
 		prometheus.CounterValue,
 		float64(stats.UsersSubscribed),
 	)
+	ch <- prometheus.MustNewConstMetric(
+		s.DeliveriesQueuedDesc,
+		prometheus.GaugeValue,
+		float64(stats.DeliveriesQueued),
+	)
 
 	for counterName, counterValue := range stats.MsgSent {
+		//counters that didn't exist at startup have no description yet
+		counterDesc, ok := s.MsgSentDesc[counterName]
+		if !ok {
+			continue
+		}
+
+		ch <- prometheus.MustNewConstMetric(
+			counterDesc,
+			prometheus.CounterValue,
+			float64(counterValue),
+		)
+	}
+
+	for severity, counterValue := range stats.MsgSentSeverity {
 		ch <- prometheus.MustNewConstMetric(
-			s.MsgSentDesc[counterName],
+			s.MsgSentSeverityDesc,
 			prometheus.CounterValue,
 			float64(counterValue),
+			severity,
+		)
+	}
+
+	for _, limit := range []string{rateLimitApiUser, rateLimitTarget} {
+		ch <- prometheus.MustNewConstMetric(
+			s.RateLimitedDesc,
+			prometheus.CounterValue,
+			float64(stats.RateLimited[limit]),
+			limit,
 		)
 	}
 }
@@ -121,6 +195,5 @@ func (s *StatsCollector) Collect(ch chan<- prometheus.Metric) {
 func (s *StatsCollector) statsHandler(w http.ResponseWriter, r *http.Request) {
 	stats := s.Get(r.Context())
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(stats)
+	writeData(w, http.StatusOK, stats)
 }
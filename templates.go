@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"text/template"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/mux"
+)
+
+const templatesKey = "templates"
+
+// messageTemplate is a named subject and message that /send can refer to
+// instead of giving the subject and message itself. Both are go templates that
+// are executed with the variables of the message.
+type messageTemplate struct {
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	Message string `json:"message"`
+}
+
+func (mt messageTemplate) MarshalBinary() ([]byte, error) {
+	return json.Marshal(mt)
+}
+
+// Validate checks that the subject and message are valid templates.
+func (mt messageTemplate) Validate() error {
+	if mt.Message == "" {
+		return fmt.Errorf("message is required")
+	}
+
+	if _, err := template.New("subject").Parse(mt.Subject); err != nil {
+		return err
+	}
+
+	_, err := template.New("message").Parse(mt.Message)
+	return err
+}
+
+// Render executes the subject and message templates. It fails when the
+// templates use variables that are not given.
+func (mt messageTemplate) Render(variables map[string]interface{}) (string, string, error) {
+	subject, err := renderTemplate("subject", mt.Subject, variables)
+	if err != nil {
+		return "", "", err
+	}
+
+	message, err := renderTemplate("message", mt.Message, variables)
+	if err != nil {
+		return "", "", err
+	}
+
+	return subject, message, nil
+}
+
+// templateData returns the variables with the target details under "target".
+func templateData(variables, targetDetails map[string]interface{}) map[string]interface{} {
+	if targetDetails == nil {
+		return variables
+	}
+
+	data := make(map[string]interface{}, len(variables)+1)
+	for k, v := range variables {
+		data[k] = v
+	}
+	data["target"] = targetDetails
+
+	return data
+}
+
+func renderTemplate(name, text string, data interface{}) (string, error) {
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+
+	return out.String(), nil
+}
+
+// LoadTemplateFiles stores the templates from the given files, which contain
+// a json object with a subject and a message. Templates loaded from files
+// replace templates with the same name that were stored through the api.
+func (ns *notificationServer) LoadTemplateFiles(ctx context.Context, files map[string]string) error {
+	for name, filePath := range files {
+		log.Println("  ", filePath)
+		inBuf, err := ioutil.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+
+		var mt messageTemplate
+		if err := json.Unmarshal(inBuf, &mt); err != nil {
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+		mt.Name = name
+
+		if err := mt.Validate(); err != nil {
+			return fmt.Errorf("%s: %v", filePath, err)
+		}
+
+		if err := ns.redisClient.HSet(ctx, templatesKey, name, mt).Err(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (ns *notificationServer) getTemplate(ctx context.Context, name string) (messageTemplate, error) {
+	var mt messageTemplate
+
+	mtString, err := ns.redisClient.HGet(ctx, templatesKey, name).Result()
+	if err != nil {
+		return mt, err
+	}
+
+	err = json.Unmarshal([]byte(mtString), &mt)
+	return mt, err
+}
+
+// applyTemplate fills in the subject and message of a message that refers to
+// a template. A 422 api error is returned when the template doesn't exist or
+// the variables don't match it.
+func (ns *notificationServer) applyTemplate(ctx context.Context, msg messageBody) (messageBody, error) {
+	if msg.Template == "" {
+		return msg, nil
+	}
+
+	mt, err := ns.getTemplate(ctx, msg.Template)
+	if err == redis.Nil {
+		return msg, newApiError(http.StatusUnprocessableEntity, errTemplateNotFound, "template %s not found", msg.Template)
+	}
+	if err != nil {
+		return msg, err
+	}
+
+	//the target details are only known per recipient, check the template with empty ones
+	var details map[string]interface{}
+	for _, t := range msg.AllTargets() {
+		if td, ok := ns.userGetters[t.Type].(TargetDetailer); ok {
+			if details == nil {
+				details = make(map[string]interface{})
+			}
+			for k, v := range td.TargetDetails() {
+				details[k] = v
+			}
+		}
+	}
+
+	subject, message, err := mt.Render(templateData(msg.Variables, details))
+	if err != nil {
+		return msg, newApiError(http.StatusUnprocessableEntity, errTemplateRenderFailed, "unable to render template %s: %v", msg.Template, err)
+	}
+
+	msg.Subject = subject
+	msg.Message = message
+
+	return msg, nil
+}
+
+func (ns *notificationServer) listTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	mtStrings, err := ns.redisClient.HGetAll(r.Context(), templatesKey).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	templates := []messageTemplate{}
+	for _, mtString := range mtStrings {
+		var mt messageTemplate
+		if err := json.Unmarshal([]byte(mtString), &mt); err != nil {
+			log.Println(err)
+			continue
+		}
+		templates = append(templates, mt)
+	}
+
+	sort.Slice(templates, func(i, j int) bool {
+		return templates[i].Name < templates[j].Name
+	})
+
+	writeData(w, http.StatusOK, templates)
+}
+
+func (ns *notificationServer) getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+
+	mt, err := ns.getTemplate(r.Context(), name)
+	if err == redis.Nil {
+		writeError(w, newApiError(http.StatusNotFound, errTemplateNotFound, "template %s not found", name))
+		return
+	}
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	writeData(w, http.StatusOK, mt)
+}
+
+func (ns *notificationServer) putTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	var mt messageTemplate
+	if err := json.NewDecoder(r.Body).Decode(&mt); err != nil {
+		writeError(w, newApiError(http.StatusBadRequest, errInvalidRequest, "Unable to decode template: %v", err))
+		return
+	}
+	mt.Name = mux.Vars(r)["name"]
+
+	if err := mt.Validate(); err != nil {
+		writeError(w, newApiError(http.StatusUnprocessableEntity, errInvalidTemplate, "Invalid template: %v", err))
+		return
+	}
+
+	if err := ns.redisClient.HSet(r.Context(), templatesKey, mt.Name, mt).Err(); err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	writeData(w, http.StatusOK, mt)
+}
+
+func (ns *notificationServer) deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	if _, ok := ns.requireApiUser(w, r); !ok {
+		return
+	}
+
+	name := mux.Vars(r)["name"]
+
+	deleted, err := ns.redisClient.HDel(r.Context(), templatesKey, name).Result()
+	if err != nil {
+		log.Println(err)
+		writeError(w, toApiError(err))
+		return
+	}
+
+	if deleted == 0 {
+		writeError(w, newApiError(http.StatusNotFound, errTemplateNotFound, "template %s not found", name))
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}